@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema of the traffic section of the configuration file.
+type traffic struct {
+	Arrivals string    `json:"arrivals,omitempty"`
+	Diurnal  []float64 `json:"diurnal,omitempty"`
+	Bursts   []burst   `json:"bursts,omitempty"`
+}
+
+// Schema of a burst window in the configuration file.
+// A burst starts every Every (counting from midnight UTC, shifted by Offset)
+// and lasts For, during which events arrive Factor times faster.
+type burst struct {
+	Every  string  `json:"every"`
+	For    string  `json:"for"`
+	Factor float64 `json:"factor"`
+	Offset string  `json:"offset,omitempty"`
+}
+
+// arrivals models the time between two consecutive events.
+type arrivals interface {
+	// next returns the time between an event at t and the event after it.
+	next(t time.Time) time.Duration
+}
+
+// constantArrivals spaces events interval apart, give or take a random jitter.
+type constantArrivals struct {
+	rand     *rand.Rand
+	interval time.Duration
+	jitter   time.Duration
+}
+
+func (a constantArrivals) next(_ time.Time) time.Duration {
+	step := a.interval
+	if a.jitter > 0 {
+		step += time.Duration(a.rand.Int63n(int64(2*a.jitter)+1)) - a.jitter
+	}
+	if step < 0 {
+		return 0
+	}
+	return step
+}
+
+// poissonArrivals models events which arrive independently of each other, on average interval apart.
+type poissonArrivals struct {
+	rand     *rand.Rand
+	interval time.Duration
+}
+
+func (a poissonArrivals) next(_ time.Time) time.Duration {
+	return time.Duration(a.rand.ExpFloat64() * float64(a.interval))
+}
+
+// diurnalArrivals are poisson arrivals of which the rate follows a 24 hour curve.
+// The weights give the relative rate for every hour of the day (in UTC), and are
+// normalized so that events are on average interval apart over a whole day.
+type diurnalArrivals struct {
+	rand     *rand.Rand
+	interval time.Duration
+	weights  [24]float64
+}
+
+// defaultDiurnalWeights follow a sine wave, which peaks at 14h and bottoms out at 2h with a tenth of the peak rate.
+var defaultDiurnalWeights = func() []float64 {
+	weights := make([]float64, 24)
+	for hour := range weights {
+		weights[hour] = 0.55 + 0.45*math.Cos(2*math.Pi*float64(hour-14)/24)
+	}
+	return weights
+}()
+
+func newDiurnalArrivals(r *rand.Rand, interval time.Duration, weights []float64) (diurnalArrivals, error) {
+	a := diurnalArrivals{rand: r, interval: interval}
+	if len(weights) != 24 {
+		return a, fmt.Errorf("A diurnal curve needs a weight for each of the 24 hours of the day, received %d", len(weights))
+	}
+	total := 0.0
+	for _, weight := range weights {
+		if weight < 0 {
+			return a, fmt.Errorf("The weights of a diurnal curve can not be negative")
+		}
+		total += weight
+	}
+	if total == 0 {
+		return a, fmt.Errorf("At least one weight of a diurnal curve should be positive")
+	}
+	for hour, weight := range weights {
+		a.weights[hour] = weight * 24 / total
+	}
+	return a, nil
+}
+
+func (a diurnalArrivals) next(t time.Time) time.Duration {
+	weight := a.weights[t.UTC().Hour()]
+	if weight == 0 {
+		// No events during this hour, so wait for the next one
+		return t.Truncate(time.Hour).Add(time.Hour).Sub(t)
+	}
+	return time.Duration(a.rand.ExpFloat64() * float64(a.interval) / weight)
+}
+
+// burstWindow is a parsed burst from the configuration.
+type burstWindow struct {
+	every  time.Duration
+	length time.Duration
+	offset time.Duration
+	factor float64
+}
+
+// contains returns true if t falls inside one of the occurrences of the window.
+func (w burstWindow) contains(t time.Time) bool {
+	sinceStart := time.Duration((t.UnixNano() - int64(w.offset)) % int64(w.every))
+	if sinceStart < 0 {
+		sinceStart += w.every
+	}
+	return sinceStart < w.length
+}
+
+// burstArrivals speed up the arrivals of another model during scheduled windows.
+type burstArrivals struct {
+	arrivals
+	windows []burstWindow
+}
+
+func (a burstArrivals) next(t time.Time) time.Duration {
+	step := a.arrivals.next(t)
+	for _, window := range a.windows {
+		if window.contains(t) {
+			step = time.Duration(float64(step) / window.factor)
+		}
+	}
+	return step
+}
+
+// parseBurst parses a burst in the every/for/factor[/offset] format used on the command line, eg: 1h/5m/10.
+func parseBurst(value string) (burst, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 3 && len(parts) != 4 {
+		return burst{}, fmt.Errorf("A burst should be formatted as every/for/factor[/offset] eg: 1h/5m/10. Received %s", value)
+	}
+	factor, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return burst{}, fmt.Errorf("Could not parse the factor of burst %s: %s", value, err)
+	}
+	b := burst{Every: parts[0], For: parts[1], Factor: factor}
+	if len(parts) == 4 {
+		b.Offset = parts[3]
+	}
+	return b, nil
+}
+
+// parseBurstWindow validates a burst and converts it into a burstWindow.
+func parseBurstWindow(b burst) (burstWindow, error) {
+	w := burstWindow{factor: b.Factor}
+	var err error
+	if w.every, err = time.ParseDuration(b.Every); err != nil || w.every <= 0 {
+		return w, fmt.Errorf("The every of a burst should be a positive duration. Received %s", b.Every)
+	}
+	if w.length, err = time.ParseDuration(b.For); err != nil || w.length <= 0 || w.length > w.every {
+		return w, fmt.Errorf("The for of a burst should be a positive duration no longer than every. Received %s", b.For)
+	}
+	if b.Offset != "" {
+		if w.offset, err = time.ParseDuration(b.Offset); err != nil {
+			return w, fmt.Errorf("The offset of a burst should be a duration. Received %s", b.Offset)
+		}
+	}
+	if w.factor <= 0 {
+		return w, fmt.Errorf("The factor of a burst should be larger than 0. Received %g", b.Factor)
+	}
+	return w, nil
+}
+
+// newArrivals creates the arrival model called kind, in which events are on average interval apart.
+// The jitter only applies to the constant model. When bursts are given, they are applied on top of the model.
+func newArrivals(kind string, r *rand.Rand, interval time.Duration, jitter time.Duration, t traffic) (arrivals, error) {
+	var model arrivals
+	switch kind {
+	case "", "constant":
+		model = constantArrivals{rand: r, interval: interval, jitter: jitter}
+	case "poisson":
+		model = poissonArrivals{rand: r, interval: interval}
+	case "diurnal":
+		weights := t.Diurnal
+		if weights == nil {
+			weights = defaultDiurnalWeights
+		}
+		diurnal, err := newDiurnalArrivals(r, interval, weights)
+		if err != nil {
+			return nil, err
+		}
+		model = diurnal
+	default:
+		return nil, fmt.Errorf("arrivals should be oneOf ['constant', 'poisson', 'diurnal']. Received %s", kind)
+	}
+
+	if len(t.Bursts) == 0 {
+		return model, nil
+	}
+	windows := make([]burstWindow, len(t.Bursts))
+	for i, b := range t.Bursts {
+		window, err := parseBurstWindow(b)
+		if err != nil {
+			return nil, err
+		}
+		windows[i] = window
+	}
+	return burstArrivals{arrivals: model, windows: windows}, nil
+}
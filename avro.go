@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// avroNamespace is the namespace of the avro schemas of the events.
+const avroNamespace = "eu.specialprivacy"
+
+// avroNames maps the event types onto the name of their avro record.
+var avroNames = map[reflect.Type]string{
+	reflect.TypeOf(log{}):          "Log",
+	reflect.TypeOf(policy{}):       "Policy",
+	reflect.TypeOf(simplepolicy{}): "SimplePolicy",
+}
+
+// schemaRegistryTimeout is the timeout of a single request to the schema registry.
+const schemaRegistryTimeout = 10 * time.Second
+
+// avroConfig holds the settings of the avro format.
+// Schema ids which are set are used as is, the others are looked up in (or registered with) the registry.
+type avroConfig struct {
+	Registry        string
+	Register        bool
+	LogSchemaID     int
+	ConsentSchemaID int
+	// Types are the event types which are written, each of them needs a schema id
+	Types []reflect.Type
+}
+
+// avroEventNames maps the event types onto their name in the flags (eg: log-schema-id).
+var avroEventNames = map[reflect.Type]string{
+	reflect.TypeOf(log{}):    "log",
+	reflect.TypeOf(policy{}): "consent",
+}
+
+// avroTypes returns the event types which are written by a run of eventType (log, consent or mixed).
+func avroTypes(eventType string, consentAware bool) []reflect.Type {
+	switch {
+	case eventType == "consent":
+		return []reflect.Type{reflect.TypeOf(policy{})}
+	case eventType == "mixed" || consentAware:
+		return []reflect.Type{reflect.TypeOf(log{}), reflect.TypeOf(policy{})}
+	default:
+		return []reflect.Type{reflect.TypeOf(log{})}
+	}
+}
+
+// avroField is a field of an event as it is encoded in avro.
+// Optional fields (int fields with omitempty) are a union of null and long, which is null when the field is 0.
+type avroField struct {
+	index    int
+	name     string
+	optional bool
+}
+
+// avroFields returns the fields of the struct type t which are encoded, in order.
+// They are named after their json tag, fields which are left out of the json are left out as well.
+func avroFields(t reflect.Type) []avroField {
+	fields := []avroField{}
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		kind := t.Field(i).Type.Kind()
+		optional := len(tag) > 1 && tag[1] == "omitempty" && (kind == reflect.Int64 || kind == reflect.Int)
+		fields = append(fields, avroField{index: i, name: name, optional: optional})
+	}
+	return fields
+}
+
+// avroSchema returns the avro schema of the type t.
+func avroSchema(t reflect.Type) interface{} {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Int64, reflect.Int:
+		return "long"
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": avroSchema(t.Elem())}
+	case reflect.Struct:
+		fields := []map[string]interface{}{}
+		for _, f := range avroFields(t) {
+			field := map[string]interface{}{"name": f.name, "type": avroSchema(t.Field(f.index).Type)}
+			if f.optional {
+				field["type"] = []interface{}{"null", field["type"]}
+				field["default"] = nil
+			}
+			fields = append(fields, field)
+		}
+		return map[string]interface{}{
+			"type":      "record",
+			"name":      avroNames[t],
+			"namespace": avroNamespace,
+			"fields":    fields,
+		}
+	default:
+		panic(fmt.Sprintf("Can not create an avro schema for %s", t))
+	}
+}
+
+// writeLong writes n as a zig-zag encoded variable length integer, which is also how
+// lengths and counts are encoded.
+func writeLong(buf *bytes.Buffer, n int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], n)])
+}
+
+// encodeAvro writes v in the avro binary encoding, according to the schema of its type.
+func encodeAvro(buf *bytes.Buffer, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		writeLong(buf, int64(v.Len()))
+		buf.WriteString(v.String())
+	case reflect.Int64, reflect.Int:
+		writeLong(buf, v.Int())
+	case reflect.Slice:
+		// Arrays are written as a single block, followed by the empty block
+		if v.Len() > 0 {
+			writeLong(buf, int64(v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				encodeAvro(buf, v.Index(i))
+			}
+		}
+		writeLong(buf, 0)
+	case reflect.Struct:
+		for _, f := range avroFields(v.Type()) {
+			field := v.Field(f.index)
+			if f.optional {
+				if field.Int() == 0 {
+					writeLong(buf, 0)
+					continue
+				}
+				writeLong(buf, 1)
+			}
+			encodeAvro(buf, field)
+		}
+	}
+}
+
+// schemaRegistry is a client for a schema registry with the confluent REST API.
+// Subjects are named after the full name of the record (eg: eu.specialprivacy.Log).
+type schemaRegistry struct {
+	url    string
+	client *http.Client
+}
+
+// schemaID returns the id of schema under subject. When it is not registered yet it is
+// registered if register is set, and an error is returned otherwise.
+func (r *schemaRegistry) schemaID(subject string, schema string, register bool) (int, error) {
+	id, status, err := r.post("/subjects/"+url.PathEscape(subject), schema)
+	if err == nil || status != http.StatusNotFound || !register {
+		return id, err
+	}
+	id, _, err = r.post("/subjects/"+url.PathEscape(subject)+"/versions", schema)
+	return id, err
+}
+
+// post posts schema to path and returns the id in the response, together with the status code.
+func (r *schemaRegistry) post(path string, schema string) (int, int, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, 0, err
+	}
+	resp, err := r.client.Post(strings.TrimSuffix(r.url, "/")+path, "application/vnd.schemaregistry.v1+json", bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, resp.StatusCode, err
+	}
+	var result struct {
+		ID      int    `json:"id"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(b, &result)
+	if resp.StatusCode/100 != 2 {
+		return 0, resp.StatusCode, fmt.Errorf("Schema registry responded to %s with %s: %s", path, resp.Status, result.Message)
+	}
+	if result.ID == 0 {
+		return 0, resp.StatusCode, fmt.Errorf("Schema registry responded to %s without a schema id", path)
+	}
+	return result.ID, resp.StatusCode, nil
+}
+
+// avroSchemaIDs returns the schema id of every event type which is written, taken from the config or from the registry.
+// The types are looked up in order, so it fails at start-up when one of them has no schema id.
+func avroSchemaIDs(config avroConfig) (map[reflect.Type]int, error) {
+	fixed := map[reflect.Type]int{
+		reflect.TypeOf(log{}):    config.LogSchemaID,
+		reflect.TypeOf(policy{}): config.ConsentSchemaID,
+	}
+	var registry *schemaRegistry
+	if config.Registry != "" {
+		registry = &schemaRegistry{url: config.Registry, client: &http.Client{Timeout: schemaRegistryTimeout}}
+	}
+	ids := map[reflect.Type]int{}
+	for _, t := range config.Types {
+		if fixed[t] != 0 {
+			ids[t] = fixed[t]
+			continue
+		}
+		if registry == nil {
+			name := avroEventNames[t]
+			return nil, fmt.Errorf("The avro format requires a schema-registry or a %s-schema-id to write %ss", name, name)
+		}
+		schema, err := json.Marshal(avroSchema(t))
+		if err != nil {
+			return nil, err
+		}
+		ids[t], err = registry.schemaID(avroNamespace+"."+avroNames[t], string(schema), config.Register)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// createAvroMarshal creates a function that encodes a log or policy in avro, in the
+// confluent wire format: a zero byte, the schema id (4 bytes, big endian) and the avro binary encoding.
+// The created function is meant to be API compatible with json.Marshal.
+func createAvroMarshal(config avroConfig) (func(v interface{}) ([]byte, error), error) {
+	ids, err := avroSchemaIDs(config)
+	if err != nil {
+		return nil, err
+	}
+	return func(v interface{}) ([]byte, error) {
+		id, ok := ids[reflect.TypeOf(v)]
+		if !ok {
+			return nil, fmt.Errorf("No avro schema id for %T, set a schema-registry or its schema id", v)
+		}
+		var buf bytes.Buffer
+		buf.WriteByte(0)
+		binary.Write(&buf, binary.BigEndian, int32(id))
+		encodeAvro(&buf, reflect.ValueOf(v))
+		return buf.Bytes(), nil
+	}, nil
+}
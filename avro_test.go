@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry is a stand-in for a schema registry, which knows the schema ids in subjects
+// and assigns ids from 100 to the schemas registered with it.
+type testRegistry struct {
+	mutex    sync.Mutex
+	subjects map[string]int
+	requests []string
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	var body struct {
+		Schema string `json:"schema"`
+	}
+	b, _ := ioutil.ReadAll(req.Body)
+	if err := json.Unmarshal(b, &body); err != nil || body.Schema == "" || req.Header.Get("Content-Type") != "application/vnd.schemaregistry.v1+json" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/subjects/")
+	subject := strings.TrimSuffix(path, "/versions")
+	if subject != path {
+		r.subjects[subject] = 100 + len(r.subjects)
+	}
+	id, ok := r.subjects[subject]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error_code": 40401, "message": "Subject not found."})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"subject": subject, "version": 1, "id": id})
+}
+
+func TestAvroSchemaIDs(t *testing.T) {
+	logType, policyType := reflect.TypeOf(log{}), reflect.TypeOf(policy{})
+	types := []reflect.Type{logType, policyType}
+	tests := []struct {
+		name     string
+		subjects map[string]int
+		config   avroConfig
+		ids      map[reflect.Type]int
+		requests []string
+		fails    bool
+	}{
+		{
+			name:     "registered",
+			subjects: map[string]int{"eu.specialprivacy.Log": 7, "eu.specialprivacy.Policy": 8},
+			config:   avroConfig{Types: types},
+			ids:      map[reflect.Type]int{logType: 7, policyType: 8},
+			requests: []string{"POST /subjects/eu.specialprivacy.Log", "POST /subjects/eu.specialprivacy.Policy"},
+		},
+		{
+			name:     "registers unknown schemas",
+			subjects: map[string]int{"eu.specialprivacy.Log": 7},
+			config:   avroConfig{Register: true, Types: types},
+			ids:      map[reflect.Type]int{logType: 7, policyType: 101},
+			requests: []string{"POST /subjects/eu.specialprivacy.Log", "POST /subjects/eu.specialprivacy.Policy", "POST /subjects/eu.specialprivacy.Policy/versions"},
+		},
+		{
+			name:     "does not register without register",
+			subjects: map[string]int{"eu.specialprivacy.Log": 7},
+			config:   avroConfig{Register: false, Types: types},
+			requests: []string{"POST /subjects/eu.specialprivacy.Log", "POST /subjects/eu.specialprivacy.Policy"},
+			fails:    true,
+		},
+		{
+			name:     "fixed ids are not looked up",
+			subjects: map[string]int{"eu.specialprivacy.Policy": 8},
+			config:   avroConfig{LogSchemaID: 3, Types: types},
+			ids:      map[reflect.Type]int{logType: 3, policyType: 8},
+			requests: []string{"POST /subjects/eu.specialprivacy.Policy"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := &testRegistry{subjects: test.subjects}
+			server := httptest.NewServer(registry)
+			defer server.Close()
+
+			test.config.Registry = server.URL
+			ids, err := avroSchemaIDs(test.config)
+			if test.fails {
+				if err == nil {
+					t.Error("expected an error")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(ids, test.ids) {
+				t.Errorf("expected ids %v, got %v", test.ids, ids)
+			}
+			if !reflect.DeepEqual(registry.requests, test.requests) {
+				t.Errorf("expected requests %v, got %v", test.requests, registry.requests)
+			}
+		})
+	}
+}
+
+func TestAvroSchemaIDsWithoutRegistry(t *testing.T) {
+	ids, err := avroSchemaIDs(avroConfig{ConsentSchemaID: 5, Types: avroTypes("consent", false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, map[reflect.Type]int{reflect.TypeOf(policy{}): 5}) {
+		t.Errorf("expected only the consent schema id, got %v", ids)
+	}
+	// Every event type which is written needs a schema id up front, not only at its first event
+	for _, config := range []avroConfig{
+		{Types: avroTypes("log", false)},
+		{LogSchemaID: 3, Types: avroTypes("mixed", false)},
+		{LogSchemaID: 3, Types: avroTypes("log", true)},
+		{LogSchemaID: 3, Types: avroTypes("consent", false)},
+	} {
+		if _, err := createAvroMarshal(config); err == nil {
+			t.Errorf("expected an error for %v without a registry", config)
+		}
+	}
+
+	marshal, err := createAvroMarshal(avroConfig{ConsentSchemaID: 5, Types: avroTypes("consent", false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := marshal(log{}); err == nil {
+		t.Error("expected an error for a log without a schema id")
+	}
+	if _, err := marshal(policy{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteLong(t *testing.T) {
+	tests := []struct {
+		n        int64
+		expected []byte
+	}{
+		{0, []byte{0x00}},
+		{-1, []byte{0x01}},
+		{1, []byte{0x02}},
+		{-64, []byte{0x7f}},
+		{64, []byte{0x80, 0x01}},
+		{1514764800000, []byte{0x80, 0xc0, 0xa4, 0xf0, 0x95, 0x58}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		writeLong(&buf, test.n)
+		if !bytes.Equal(buf.Bytes(), test.expected) {
+			t.Errorf("expected %d to be written as % x, got % x", test.n, test.expected, buf.Bytes())
+		}
+	}
+}
+
+func TestAvroWireFormat(t *testing.T) {
+	marshal, err := createAvroMarshal(avroConfig{LogSchemaID: 0x01020304, ConsentSchemaID: 5, Types: avroTypes("mixed", false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected []byte
+	}{
+		{
+			name:  "log",
+			value: log{Timestamp: 1, Process: "p", UserID: "u", Data: []string{"a", "b"}, EventID: "e"},
+			expected: []byte{
+				0x00, 0x01, 0x02, 0x03, 0x04, // magic byte and schema id
+				0x02,      // timestamp
+				0x02, 'p', // process
+				0x00, 0x00, 0x00, 0x00, // purpose, processing, recipient and storage
+				0x02, 'u', // userID
+				0x04, 0x02, 'a', 0x02, 'b', 0x00, // data: a block of 2 items and the terminator
+				0x02, 'e', // eventID
+			},
+		},
+		{
+			name:  "consent without expiry",
+			value: policy{ConsentID: "ignored", Timestamp: -1, UserID: "u"},
+			expected: []byte{
+				0x00, 0x00, 0x00, 0x00, 0x05,
+				0x01,      // timestamp
+				0x02, 'u', // userID
+				0x00, // no simplePolicies, only the terminator
+				0x00, // expires: null
+			},
+		},
+		{
+			name: "consent with expiry",
+			value: policy{Timestamp: 2, UserID: "u", Expires: 3, SimplePolicies: []simplepolicy{
+				{Purpose: "a", Processing: "b", Recipient: "c", Storage: "d", Data: "e"},
+			}},
+			expected: []byte{
+				0x00, 0x00, 0x00, 0x00, 0x05,
+				0x04,
+				0x02, 'u',
+				0x02, 0x02, 'a', 0x02, 'b', 0x02, 'c', 0x02, 'd', 0x02, 'e', 0x00,
+				0x02, 0x06, // expires: the long branch of the union, and 3
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := marshal(test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(actual, test.expected) {
+				t.Errorf("expected % x, got % x", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestAvroSchema(t *testing.T) {
+	schema, err := json.Marshal(avroSchema(reflect.TypeOf(policy{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"fields":[{"name":"timestamp","type":"long"},{"name":"userID","type":"string"},` +
+		`{"name":"simplePolicies","type":{"items":{"fields":[{"name":"purposeCollection","type":"string"},` +
+		`{"name":"processingCollection","type":"string"},{"name":"recipientCollection","type":"string"},` +
+		`{"name":"storageCollection","type":"string"},{"name":"dataCollection","type":"string"}],` +
+		`"name":"SimplePolicy","namespace":"eu.specialprivacy","type":"record"},"type":"array"}},` +
+		`{"default":null,"name":"expires","type":["null","long"]}],"name":"Policy","namespace":"eu.specialprivacy","type":"record"}`
+	if string(schema) != expected {
+		t.Errorf("expected schema %s, got %s", expected, schema)
+	}
+}
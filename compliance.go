@@ -0,0 +1,222 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/Shopify/sarama"
+)
+
+// label describes the ground truth of a log generated in consent aware mode.
+// It is written out of band, so it never ends up in the log itself.
+type label struct {
+	EventID   string `json:"eventID"`
+	UserID    string `json:"userID"`
+	Compliant bool   `json:"compliant"`
+	Violation string `json:"violation,omitempty"`
+}
+
+// headers renders the label as kafka record headers.
+func (l *label) headers() []sarama.RecordHeader {
+	if l == nil {
+		return nil
+	}
+	return []sarama.RecordHeader{
+		{Key: []byte("compliant"), Value: []byte(strconv.FormatBool(l.Compliant))},
+		{Key: []byte("violation"), Value: []byte(l.Violation)},
+	}
+}
+
+// policyDimensions are the attributes of a log on which it can violate a policy.
+var policyDimensions = []string{"purpose", "processing", "recipient", "storage", "data"}
+
+// anyValues contains for each dimension the value which matches every other value of that dimension.
+var anyValues = map[string]string{
+	"purpose":    expandPrefix("spl:AnyPurpose"),
+	"processing": expandPrefix("spl:AnyProcessing"),
+	"recipient":  expandPrefix("spl:AnyRecipient"),
+	"storage":    expandPrefix("spl:AnyLocation"),
+	"data":       expandPrefix("spl:AnyData"),
+}
+
+// values returns the possible values of a dimension.
+func (c config) values(dimension string) []string {
+	switch dimension {
+	case "purpose":
+		return c.Purpose
+	case "processing":
+		return c.Processing
+	case "recipient":
+		return c.Recipient
+	case "storage":
+		return c.Storage
+	default:
+		return c.Data
+	}
+}
+
+// get returns the value of a dimension of the simple policy.
+func (sp simplepolicy) get(dimension string) string {
+	switch dimension {
+	case "purpose":
+		return sp.Purpose
+	case "processing":
+		return sp.Processing
+	case "recipient":
+		return sp.Recipient
+	case "storage":
+		return sp.Storage
+	default:
+		return sp.Data
+	}
+}
+
+// set changes a single valued dimension of the log.
+func (l *log) set(dimension string, value string) {
+	switch dimension {
+	case "purpose":
+		l.Purpose = value
+	case "processing":
+		l.Processing = value
+	case "recipient":
+		l.Recipient = value
+	case "storage":
+		l.Storage = value
+	}
+}
+
+// matches returns true if the value of a dimension in a policy allows value to be used.
+func matches(dimension string, policyValue string, value string) bool {
+	return policyValue == value || policyValue == anyValues[dimension]
+}
+
+// permits returns true if the simple policy allows data to be used in the way described by l.
+func (sp simplepolicy) permits(l log, data string) bool {
+	return matches("purpose", sp.Purpose, l.Purpose) &&
+		matches("processing", sp.Processing, l.Processing) &&
+		matches("recipient", sp.Recipient, l.Recipient) &&
+		matches("storage", sp.Storage, l.Storage) &&
+		matches("data", sp.Data, data)
+}
+
+// isPermitted returns true if any of the simple policies of p allows data to be used in the way described by l.
+func isPermitted(p policy, l log, data string) bool {
+	for _, sp := range p.SimplePolicies {
+		if sp.permits(l, data) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCovered returns true if every data category used by l is permitted by p.
+// A withdrawn consent (without simple policies) or a consent which expired before l covers nothing.
+func isCovered(p policy, l log) bool {
+	if len(p.SimplePolicies) == 0 || (p.Expires != 0 && l.Timestamp >= p.Expires) {
+		return false
+	}
+	for _, data := range l.Data {
+		if !isPermitted(p, l, data) {
+			return false
+		}
+	}
+	return true
+}
+
+// makeConsents creates a consent with at least one simple policy for every user in the config.
+// The consents are kept on the generator, so that makeLabelledLog can check logs against them.
+func (g *generator) makeConsents() []message {
+	g.consents = make(map[string]policy, len(g.config.UserID))
+	output := make([]message, 0, len(g.config.UserID))
+	for _, userID := range g.config.UserID {
+		if _, ok := g.consents[userID]; ok {
+			continue
+		}
+		consent := g.makePolicy(userID, g.rand.Intn(g.maxSize)+1)
+		g.consents[userID] = consent
+		output = append(output, message{Key: userID, Value: consent})
+	}
+	return output
+}
+
+// pickValue returns a concrete value which is matched by policyValue.
+func (g *generator) pickValue(dimension string, policyValue string) string {
+	if policyValue == anyValues[dimension] {
+		return getRandomValue(g.rand, g.config.values(dimension))
+	}
+	return policyValue
+}
+
+// makeLabelledLog creates a log for a user with a consent created by makeConsents.
+// The log is covered by that consent, unless it is turned into a violation of
+// a single dimension, which happens with a probability of violationRate.
+// The label on the message records which of the two happened.
+func (g *generator) makeLabelledLog() message {
+	userID := getRandomValue(g.rand, g.config.UserID)
+	consent := g.consents[userID]
+	sp := consent.SimplePolicies[g.rand.Intn(len(consent.SimplePolicies))]
+
+	log := log{
+		Timestamp:  toMillis(g.clock()),
+		Process:    getRandomValue(g.rand, g.config.Process),
+		Purpose:    g.pickValue("purpose", sp.Purpose),
+		Processing: g.pickValue("processing", sp.Processing),
+		Recipient:  g.pickValue("recipient", sp.Recipient),
+		Storage:    g.pickValue("storage", sp.Storage),
+		UserID:     userID,
+		EventID:    randomUUID(g.rand),
+	}
+	// Every data category allowed for this particular usage can be part of a compliant log
+	allowed := []string{g.pickValue("data", sp.Data)}
+	for _, data := range g.config.Data {
+		if data != allowed[0] && isPermitted(consent, log, data) {
+			allowed = append(allowed, data)
+		}
+	}
+	log.Data = getRandomList(g.rand, allowed)
+
+	l := &label{EventID: log.EventID, UserID: userID, Compliant: true}
+	if g.rand.Float64() < g.violationRate {
+		if dimension, ok := g.violate(consent, &log); ok {
+			l.Compliant = false
+			l.Violation = dimension
+		}
+	}
+
+	return message{
+		Key:   log.EventID,
+		Value: log,
+		Label: l,
+	}
+}
+
+// violate changes a single dimension of l, so that it is no longer covered by consent.
+// The dimension is picked at random from those for which the config contains a violating value.
+// It returns false if no such dimension exists, in which case l is left untouched.
+func (g *generator) violate(consent policy, l *log) (string, bool) {
+	for _, i := range g.rand.Perm(len(policyDimensions)) {
+		dimension := policyDimensions[i]
+		candidates := []string{}
+		for _, value := range g.config.values(dimension) {
+			violation := *l
+			if dimension == "data" {
+				violation.Data = []string{value}
+			} else {
+				violation.set(dimension, value)
+			}
+			if !isCovered(consent, violation) {
+				candidates = append(candidates, value)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		value := getRandomValue(g.rand, candidates)
+		if dimension == "data" {
+			l.Data = append(l.Data, value)
+		} else {
+			l.set(dimension, value)
+		}
+		return dimension, true
+	}
+	return "", false
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestIsCovered(t *testing.T) {
+	consent := policy{
+		Timestamp: 1000,
+		SimplePolicies: []simplepolicy{
+			{Purpose: "marketing", Processing: "collect", Recipient: "ours", Storage: "eu", Data: "contact"},
+			{Purpose: "marketing", Processing: "collect", Recipient: "ours", Storage: "eu", Data: "location"},
+			{Purpose: anyValues["purpose"], Processing: anyValues["processing"], Recipient: anyValues["recipient"], Storage: anyValues["storage"], Data: "public"},
+		},
+	}
+	covered := log{Timestamp: 2000, Purpose: "marketing", Processing: "collect", Recipient: "ours", Storage: "eu", Data: []string{"contact", "location"}}
+	// Only the simple policy with any values permits this usage
+	anyUsage := log{Timestamp: 2000, Purpose: "sales", Processing: "copy", Recipient: "public", Storage: "us", Data: []string{"public"}}
+	tests := []struct {
+		name    string
+		change  func(p *policy, l *log)
+		covered bool
+	}{
+		{name: "covered", change: func(p *policy, l *log) {}, covered: true},
+		{name: "any values", change: func(p *policy, l *log) { *l = anyUsage }, covered: true},
+		{name: "purpose", change: func(p *policy, l *log) { l.Purpose = "sales" }},
+		{name: "processing", change: func(p *policy, l *log) { l.Processing = "copy" }},
+		{name: "recipient", change: func(p *policy, l *log) { l.Recipient = "public" }},
+		{name: "storage", change: func(p *policy, l *log) { l.Storage = "us" }},
+		{name: "data", change: func(p *policy, l *log) { l.Data = append(l.Data, "health") }},
+		{name: "data of another usage", change: func(p *policy, l *log) { l.Purpose = "sales"; l.Data = []string{"contact", "public"} }},
+		{name: "withdrawn", change: func(p *policy, l *log) { p.SimplePolicies = nil }},
+		{name: "withdrawn without data", change: func(p *policy, l *log) { p.SimplePolicies = nil; l.Data = nil }},
+		{name: "not expired", change: func(p *policy, l *log) { p.Expires = 2001 }, covered: true},
+		{name: "expired", change: func(p *policy, l *log) { p.Expires = 2000 }},
+		{name: "expired before", change: func(p *policy, l *log) { p.Expires = 1500 }},
+	}
+	for _, test := range tests {
+		p, l := consent, covered
+		l.Data = append([]string{}, covered.Data...)
+		test.change(&p, &l)
+		if actual := isCovered(p, l); actual != test.covered {
+			t.Errorf("%s: expected covered to be %t, got %t", test.name, test.covered, actual)
+		}
+	}
+}
+
+// testGenerator returns a seeded generator with a consent for every user, as in consent aware mode.
+func testGenerator(c config, violationRate float64) *generator {
+	g := &generator{
+		rand:          rand.New(rand.NewSource(1)),
+		clock:         func() time.Time { return seedEpoch },
+		config:        c,
+		maxSize:       3,
+		violationRate: violationRate,
+	}
+	g.makeConsents()
+	return g
+}
+
+func TestMakeLabelledLog(t *testing.T) {
+	for _, violationRate := range []float64{0, 0.3, 1} {
+		g := testGenerator(makeDefaultConfig(rand.New(rand.NewSource(1))), violationRate)
+		violations := 0
+		for i := 0; i < 1000; i++ {
+			msg := g.makeLabelledLog()
+			l, label := msg.Value.(log), msg.Label
+			if label == nil || label.EventID != l.EventID || label.UserID != l.UserID {
+				t.Fatalf("expected a label for %v, got %v", l, label)
+			}
+			if covered := isCovered(g.consents[l.UserID], l); covered != label.Compliant {
+				t.Fatalf("expected %v to be labelled compliant %t, got %v", l, covered, label)
+			}
+			if !label.Compliant {
+				violations++
+			}
+		}
+		switch {
+		case violationRate == 0 && violations != 0:
+			t.Errorf("expected no violations, got %d", violations)
+		case violationRate == 1 && violations != 1000:
+			t.Errorf("expected every log to be a violation, got %d", violations)
+		case violationRate == 0.3 && (violations < 250 || violations > 350):
+			t.Errorf("expected about 300 violations, got %d", violations)
+		}
+	}
+}
+
+func TestViolate(t *testing.T) {
+	for _, dimension := range policyDimensions {
+		t.Run(dimension, func(t *testing.T) {
+			// Only the dimension under test has a value which violates the consent
+			c := config{
+				Process:    []string{"p"},
+				Purpose:    []string{"marketing"},
+				Processing: []string{"collect"},
+				Recipient:  []string{"ours"},
+				Storage:    []string{"eu"},
+				UserID:     []string{"u"},
+				Data:       []string{"contact"},
+			}
+			switch dimension {
+			case "purpose":
+				c.Purpose = append(c.Purpose, "sales")
+			case "processing":
+				c.Processing = append(c.Processing, "copy")
+			case "recipient":
+				c.Recipient = append(c.Recipient, "public")
+			case "storage":
+				c.Storage = append(c.Storage, "us")
+			case "data":
+				c.Data = append(c.Data, "health")
+			}
+			g := testGenerator(c, 1)
+			consent := policy{UserID: "u", SimplePolicies: []simplepolicy{{Purpose: "marketing", Processing: "collect", Recipient: "ours", Storage: "eu", Data: "contact"}}}
+			g.consents["u"] = consent
+			for i := 0; i < 20; i++ {
+				msg := g.makeLabelledLog()
+				if msg.Label.Compliant || msg.Label.Violation != dimension {
+					t.Fatalf("expected a violation of the %s, got %v", dimension, msg.Label)
+				}
+				if isCovered(consent, msg.Value.(log)) {
+					t.Fatalf("expected %v not to be covered", msg.Value)
+				}
+			}
+
+			// Without a violating value the log stays compliant
+			l := log{Purpose: "marketing", Processing: "collect", Recipient: "ours", Storage: "eu", Data: []string{"contact"}}
+			g.config = config{Purpose: c.Purpose[:1], Processing: c.Processing[:1], Recipient: c.Recipient[:1], Storage: c.Storage[:1], Data: c.Data[:1]}
+			if violation, ok := g.violate(consent, &l); ok {
+				t.Errorf("expected no violation to be possible, got %s", violation)
+			}
+		})
+	}
+}
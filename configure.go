@@ -9,13 +9,14 @@ import (
 	"github.com/urfave/cli"
 )
 
-// Create an array of the names of all config struct keys
+// Create an array of the names of all config struct keys holding a list of attribute values
 var configAttributes = func() []string {
 	configType := reflect.TypeOf(config{})
-	numAttributes := configType.NumField()
-	attributes := make([]string, numAttributes)
-	for i := 0; i < numAttributes; i++ {
-		attributes[i] = configType.Field(i).Name
+	attributes := []string{}
+	for i := 0; i < configType.NumField(); i++ {
+		if configType.Field(i).Type == reflect.TypeOf([]string{}) {
+			attributes = append(attributes, configType.Field(i).Name)
+		}
 	}
 	return attributes
 }()
@@ -35,12 +36,16 @@ func getPrefixFlag(v string) string {
 // createCommandFlags returns a list of cli.Flag configurations.
 // It will append a few hardcoded flags to a list of flags for each config property.
 func createCommandFlags(attributes []string) []cli.Flag {
-	numRegularFlags := 1
+	numRegularFlags := 2
 	output := make([]cli.Flag, len(attributes)*2+numRegularFlags)
 	output[0] = cli.StringFlag{
 		Name:  "output, o",
 		Usage: "The `file` to which the generated configuration should be written (default: stdout)",
 	}
+	output[1] = cli.BoolFlag{
+		Name:  "force",
+		Usage: "Set to overwrite the output file if it already exists",
+	}
 	for i, v := range attributes {
 		index := i*2 + numRegularFlags
 		output[index] = cli.IntFlag{
@@ -73,7 +78,7 @@ var configureCommand = cli.Command{
 	Flags:     createCommandFlags(configAttributes),
 	Action: func(c *cli.Context) error {
 		// Parse the output flag
-		output, err := getOutput(c.String("output"))
+		output, err := getOutput(c.String("output"), false, c.Bool("force"))
 		if err != nil {
 			return cli.NewExitError(err.Error(), 1)
 		}
@@ -100,6 +105,10 @@ var configureCommand = cli.Command{
 		if err != nil {
 			return cli.NewExitError(err.Error(), 1)
 		}
+		err = output.Commit()
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
 
 		return nil
 	},
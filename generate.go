@@ -1,36 +1,100 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
-	"text/template"
+	"strings"
 	"time"
 
+	gometrics "github.com/rcrowley/go-metrics"
 	"github.com/urfave/cli"
-	sarama "gopkg.in/Shopify/sarama.v1"
 )
 
 type message struct {
 	Key   string
 	Value interface{}
+	Label *label
+}
+
+// eventType returns the type of the event in the message (log or consent).
+func (m message) eventType() string {
+	if _, ok := m.Value.(policy); ok {
+		return "consent"
+	}
+	return "log"
+}
+
+// seedEpoch is the time at which the simulated clock of a seeded run starts.
+var seedEpoch = time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// generator holds the state shared by the event producers.
+// All randomness is drawn from rand and all timestamps from clock, so that a
+// generator created with a fixed seed produces the same events on every run.
+type generator struct {
+	rand    *rand.Rand
+	clock   func() time.Time
+	config  config
+	maxSize int
+
+	// The current consent of every user, used in consent aware mode and for the consent lifecycle
+	consents map[string]policy
+
+	// Only used in consent aware mode
+	violationRate float64
+
+	// Only used for the consent lifecycle
+	lifecycle      bool
+	withdrawalRate float64
+	consentTTL     time.Duration
+
+	// Only used for type mixed
+	consentRatio int
+	count        int
+}
+
+// simClock is a simulated clock used to timestamp events instead of the wall clock.
+// It advances according to the arrival model for every event, but never goes back in time.
+type simClock struct {
+	now      time.Time
+	end      time.Time
+	arrivals arrivals
+}
+
+// tick returns the timestamp for the next event and advances the clock.
+func (s *simClock) tick() time.Time {
+	t := s.now
+	if step := s.arrivals.next(t); step > 0 {
+		s.now = s.now.Add(step)
+	}
+	return t
+}
+
+// done returns true once the clock has passed its end time (if it has one).
+func (s *simClock) done() bool {
+	return !s.end.IsZero() && s.now.After(s.end)
+}
+
+// toMillis converts t to a unix timestamp in milliseconds.
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
 }
 
 // makeLog creates a log statement from a random selection of the values in config.
-func makeLog(config config, _ int) message {
+func (g *generator) makeLog() message {
 	log := log{
-		Timestamp:  time.Now().UnixNano() / int64(time.Millisecond),
-		Process:    getRandomValue(config.Process),
-		Purpose:    getRandomValue(config.Purpose),
-		Processing: getRandomValue(config.Processing),
-		Recipient:  getRandomValue(config.Recipient),
-		Storage:    getRandomValue(config.Storage),
-		UserID:     getRandomValue(config.UserID),
-		Data:       getRandomList(config.Data),
-		EventID:    randomUUID(),
+		Timestamp:  toMillis(g.clock()),
+		Process:    getRandomValue(g.rand, g.config.Process),
+		Purpose:    getRandomValue(g.rand, g.config.Purpose),
+		Processing: getRandomValue(g.rand, g.config.Processing),
+		Recipient:  getRandomValue(g.rand, g.config.Recipient),
+		Storage:    getRandomValue(g.rand, g.config.Storage),
+		UserID:     getRandomValue(g.rand, g.config.UserID),
+		Data:       getRandomList(g.rand, g.config.Data),
+		EventID:    randomUUID(g.rand),
 	}
 	return message{
 		Key:   log.EventID,
@@ -38,72 +102,154 @@ func makeLog(config config, _ int) message {
 	}
 }
 
-// makeConsent creates a consent event from a random selection of the values in the config.
-func makeConsent(config config, maxSize int) message {
-	simplePolicies := make([]simplepolicy, rand.Intn(maxSize))
+// makePolicy creates a policy for userID with n simple policies from a random selection of the values in the config.
+func (g *generator) makePolicy(userID string, n int) policy {
+	simplePolicies := make([]simplepolicy, n)
 	for i := range simplePolicies {
 		simplePolicies[i] = simplepolicy{
-			Purpose:    getRandomValue(config.Purpose),
-			Processing: getRandomValue(config.Processing),
-			Recipient:  getRandomValue(config.Recipient),
-			Storage:    getRandomValue(config.Storage),
-			Data:       getRandomValue(config.Data),
+			Purpose:    getRandomValue(g.rand, g.config.Purpose),
+			Processing: getRandomValue(g.rand, g.config.Processing),
+			Recipient:  getRandomValue(g.rand, g.config.Recipient),
+			Storage:    getRandomValue(g.rand, g.config.Storage),
+			Data:       getRandomValue(g.rand, g.config.Data),
 		}
 	}
-	policy := policy{
-		ConsentID:      randomUUID(),
-		Timestamp:      time.Now().UnixNano() / int64(time.Millisecond),
-		UserID:         getRandomValue(config.UserID),
+	return policy{
+		ConsentID:      randomUUID(g.rand),
+		Timestamp:      toMillis(g.clock()),
+		UserID:         userID,
 		SimplePolicies: simplePolicies,
 	}
+}
+
+// makeConsent creates a consent event from a random selection of the values in the config.
+func (g *generator) makeConsent() message {
+	policy := g.makePolicy(getRandomValue(g.rand, g.config.UserID), g.rand.Intn(g.maxSize))
 	return message{
 		Key:   policy.UserID,
 		Value: policy,
 	}
 }
 
-// generateLog sends a maximum of n random messages through channel c at the a particular rate.
+// makeMixed creates a consent after every consentRatio logs, and a log otherwise.
+func (g *generator) makeMixed() message {
+	g.count++
+	if g.count%(g.consentRatio+1) == 0 {
+		return g.nextConsent()
+	}
+	return g.makeLog()
+}
+
+// generateLog sends a maximum of n random messages through channel c, at the times scheduled by the pacer.
 // The function is meant to run a a go-routine
-// In case n <= 0 the function will keep the channel running indefinitely
+// In case n <= 0 the function will keep the channel running indefinitely, unless done is given.
+// The channel is closed as soon as done returns true or ctx is cancelled.
 func generateLog(
-	config config,
+	ctx context.Context,
 	n int,
-	rate time.Duration,
-	maxSize int,
-	producer func(config, int) message,
+	pace *pacer,
+	producer func() message,
+	done func() bool,
 	c chan message,
 ) {
-	if n <= 0 {
-		for {
-			payload := producer(config, maxSize)
-			c <- payload
-			time.Sleep(rate)
-		}
-	} else {
-		for i := 0; i < n; i++ {
-			payload := producer(config, maxSize)
-			c <- payload
-			time.Sleep(rate)
-		}
-		close(c)
+	defer close(c)
+	for i := 0; n <= 0 || i < n; i++ {
+		if done != nil && done() {
+			return
+		}
+		if pace.wait(ctx) != nil {
+			return
+		}
+		payload := producer()
+		select {
+		case c <- payload:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-// createTTLMarshal creates a function that renders a value in tuttle syntax according to the ttlTemplate.
-// The created function is meant to be API compatible with json.Marshal.
-//
-// In the future we should replace this with a generic RDF library that renders
-// a struct based on meta data defined by field tags (comparable to how json
-// and xml work right now)
-func createTTLMarshal(ttlTemplate *template.Template) func(v interface{}) ([]byte, error) {
-	return func(v interface{}) ([]byte, error) {
-		var buf bytes.Buffer
-		err := ttlTemplate.Execute(&buf, v)
-		if err != nil {
-			return nil, err
+// serializerOptions are the settings of the serializers which are not part of the format.
+type serializerOptions struct {
+	// graph is the scheme by which the quad formats (nq and trig) put every event in a named graph
+	graph string
+	avro  avroConfig
+}
+
+// getSerializer returns the function which renders logs and consents in format.
+func getSerializer(format string, options serializerOptions) (func(interface{}) ([]byte, error), error) {
+	graph := options.graph
+	switch format {
+	case "json":
+		return json.Marshal, nil
+	case "ttl":
+		return createTTLMarshal(), nil
+	case "trig":
+		return createTriGMarshal(graph), nil
+	case "nt":
+		return createNQuadsMarshal(""), nil
+	case "nq":
+		return createNQuadsMarshal(graph), nil
+	case "jsonld":
+		return createJSONLDMarshal(false), nil
+	case "jsonld-expanded":
+		return createJSONLDMarshal(true), nil
+	case "avro":
+		return createAvroMarshal(options.avro)
+	default:
+		return nil, fmt.Errorf("format should be oneOf ['json', 'ttl', 'nt', 'nq', 'trig', 'jsonld', 'jsonld-expanded', 'avro']. Recieved %s", format)
+	}
+}
+
+// target is an output together with the serializer for the events written to it.
+type target struct {
+	sink      sink
+	format    string
+	serialize func(interface{}) ([]byte, error)
+}
+
+// openTarget opens the sink for output, which is written in the format given
+// in the output URI (eg: file:///tmp/logs.ttl?format=ttl) or otherwise in defaultFormat.
+// The binary avro format can only be written to kafka.
+func openTarget(output string, defaultFormat string, serializers serializerOptions, options sinkOptions) (*target, error) {
+	output, format, err := splitFormat(output)
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = defaultFormat
+	}
+	serializer, err := getSerializer(format, serializers)
+	if err != nil {
+		return nil, err
+	}
+	options.format = format
+	s, err := openSink(output, options)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.(*kafkaSink); format == "avro" && !ok {
+		abortSink(s)
+		if output == "" || output == "-" {
+			output = "stdout"
 		}
-		return buf.Bytes(), nil
+		return nil, fmt.Errorf("The avro format can only be written to kafka, not to %s", output)
+	}
+	return &target{sink: s, format: format, serialize: serializer}, nil
+}
+
+// writeLabel writes l as a json line to output.
+// Nothing is written when either of them is nil.
+func writeLabel(output *outputFile, l *label) error {
+	if output == nil || l == nil {
+		return nil
 	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(output, "%s\n", b)
+	return err
 }
 
 var generateCommand = cli.Command{
@@ -118,32 +264,113 @@ var generateCommand = cli.Command{
 			Usage:  "The `rate` at which the generator outputs events. Understands golang duration syntax eg: 1s",
 			EnvVar: "RATE",
 		},
+		cli.Float64Flag{
+			Name:   "eps",
+			Usage:  "The `number` of events per second the generator targets, as an alternative to rate",
+			EnvVar: "EPS",
+		},
+		cli.DurationFlag{
+			Name:   "report-interval",
+			Usage:  "The `interval` at which the achieved rate is reported on stderr. The rate is always reported when the generator finishes (default: never)",
+			EnvVar: "REPORT_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "metrics-addr",
+			Usage:  "The `address` (eg: :9100) on which metrics are served in the prometheus format at /metrics (default: disabled)",
+			EnvVar: "METRICS_ADDR",
+		},
 		cli.IntFlag{
 			Name:   "num",
 			Value:  10,
 			Usage:  "The `number` of events to create. Numbers <= 0 will create an infinite stream",
 			EnvVar: "NUM",
 		},
+		cli.DurationFlag{
+			Name:   "duration",
+			Usage:  "The maximum `duration` of the run, combined with num the run stops at whichever comes first. 0 means no limit",
+			EnvVar: "DURATION",
+		},
+		cli.IntFlag{
+			Name:   "workers",
+			Value:  1,
+			Usage:  "The `number` of workers serializing events in parallel. Events are still generated (and labelled) one by one, which keeps seeded runs reproducible, and written in the order in which they were generated",
+			EnvVar: "WORKERS",
+		},
+		cli.StringFlag{
+			Name:   "arrivals",
+			Usage:  "The `model` for the time between events (constant, poisson or diurnal). Events are on average rate (or event-interval) apart (default: constant)",
+			EnvVar: "ARRIVALS",
+		},
+		cli.StringSliceFlag{
+			Name:   "burst",
+			Usage:  "A burst `window` formatted as every/for/factor[/offset], during which events arrive factor times faster. eg: 1h/5m/10 Can be repeated",
+			EnvVar: "BURST",
+		},
+		cli.StringFlag{
+			Name:   "start-time",
+			Usage:  "The `time` of the first event (RFC3339 or yyyy-mm-dd). Timestamps are then simulated instead of taken from the clock, so history can be generated as fast as possible",
+			EnvVar: "START_TIME",
+		},
+		cli.StringFlag{
+			Name:   "end-time",
+			Usage:  "The `time` (RFC3339 or yyyy-mm-dd) after which no more events are generated (only applicable with start-time)",
+			EnvVar: "END_TIME",
+		},
+		cli.DurationFlag{
+			Name:   "event-interval",
+			Usage:  "The `duration` between the timestamps of simulated events. Understands golang duration syntax eg: 5m (default: rate or 1ms)",
+			EnvVar: "EVENT_INTERVAL",
+		},
+		cli.DurationFlag{
+			Name:   "event-jitter",
+			Usage:  "The maximum `duration` by which the interval between simulated events is randomly shortened or lengthened, at most event-interval",
+			EnvVar: "EVENT_JITTER",
+		},
 		cli.StringFlag{
 			Name:   "config, c",
 			Usage:  "Path to config `file` containing alternative values for the events",
 			EnvVar: "CONFIG",
 		},
-		cli.StringFlag{
-			Name:   "output, o",
-			Usage:  "The `file` to which the generated events should be written. If the special value 'kafka' is used, logs will be produced on kafka. (default: stdout)",
-			EnvVar: "OUTPUT",
+		cli.StringSliceFlag{
+			Name:  "output, o",
+			Usage: "The `output` to which the generated events should be written: a file, a URI (eg: file:///tmp/logs.json, kafka://broker:9092/topic or https://host/logs) or - for stdout. If the special value 'kafka' is used, logs will be produced on kafka. Can be repeated to write every event to several outputs, URIs can override the format (eg: file:///tmp/logs.ttl?format=ttl). Multiple outputs in $OUTPUT are separated by whitespace (default: stdout) [$OUTPUT]",
 		},
 		cli.StringFlag{
 			Name:   "format, f",
 			Value:  "json",
-			Usage:  "The serialization `format` used to write the events (json or ttl)",
+			Usage:  "The serialization `format` used to write the events (json, ttl, nt, nq, trig, jsonld, jsonld-expanded or avro), unless an output overrides it",
 			EnvVar: "FORMAT",
 		},
+		cli.StringFlag{
+			Name:   "graph",
+			Value:  "event",
+			Usage:  "The named `graph` in which every event is put by the nq and trig formats: a graph per event, user or process. Events without a user or process are put in the default graph",
+			EnvVar: "GRAPH",
+		},
+		cli.StringFlag{
+			Name:   "schema-registry",
+			Usage:  "The `url` of the schema registry in which the schemas of the avro format are looked up",
+			EnvVar: "SCHEMA_REGISTRY",
+		},
+		cli.BoolTFlag{
+			Name:   "schema-register",
+			Usage:  "Register the schemas of the avro format when they are not in the schema registry yet. Use --schema-register=false to only look them up",
+			EnvVar: "SCHEMA_REGISTER",
+		},
+		cli.IntFlag{
+			Name:   "log-schema-id",
+			Usage:  "The schema `id` written in front of logs in the avro format, instead of looking it up in the schema registry",
+			EnvVar: "LOG_SCHEMA_ID",
+		},
+		cli.IntFlag{
+			Name:   "consent-schema-id",
+			Usage:  "The schema `id` written in front of consents in the avro format, instead of looking it up in the schema registry",
+			EnvVar: "CONSENT_SCHEMA_ID",
+		},
 		cli.StringFlag{
 			Name:   "type, t",
 			Value:  "log",
-			Usage:  "The `type` of event to be generated (log or consent)",
+			Usage:  "The `type` of event to be generated (log, consent or mixed)",
 			EnvVar: "TYPE",
 		},
 		cli.IntFlag{
@@ -152,6 +379,54 @@ var generateCommand = cli.Command{
 			Usage:  "The maximum `number` of policies to be used in a single consent (only applicable for type consent)",
 			EnvVar: "MAX_POLICY_SIZE",
 		},
+		cli.BoolFlag{
+			Name:   "consent-lifecycle",
+			Usage:  "Set to let the consent of every user evolve over time through updates and withdrawals, instead of generating unrelated consents (only applicable for type consent or mixed)",
+			EnvVar: "CONSENT_LIFECYCLE",
+		},
+		cli.Float64Flag{
+			Name:   "withdrawal-rate",
+			Value:  0.05,
+			Usage:  "The `fraction` of consent updates which withdraw the consent of a user (only applicable with consent-lifecycle)",
+			EnvVar: "WITHDRAWAL_RATE",
+		},
+		cli.DurationFlag{
+			Name:   "consent-ttl",
+			Usage:  "The `duration` after which a consent expires. Understands golang duration syntax eg: 720h. Consents do not expire when it is 0 (only applicable with consent-lifecycle)",
+			EnvVar: "CONSENT_TTL",
+		},
+		cli.IntFlag{
+			Name:   "consent-ratio",
+			Value:  10,
+			Usage:  "The `number` of logs generated for every consent (only applicable for type mixed)",
+			EnvVar: "CONSENT_RATIO",
+		},
+		cli.Int64Flag{
+			Name:   "seed",
+			Usage:  "The `number` used to seed the random generator. Runs with the same seed and options produce identical output, using simulated timestamps (default: random)",
+			EnvVar: "SEED",
+		},
+		cli.BoolFlag{
+			Name:   "consent-aware",
+			Usage:  "Set to create a consent for every user first and generate logs which either comply with or violate that consent (only applicable for type log)",
+			EnvVar: "CONSENT_AWARE",
+		},
+		cli.Float64Flag{
+			Name:   "violation-rate",
+			Value:  0.1,
+			Usage:  "The `fraction` of logs which violate the consent of their user (only applicable with consent-aware)",
+			EnvVar: "VIOLATION_RATE",
+		},
+		cli.StringFlag{
+			Name:   "consent-output",
+			Usage:  "The `output` to which consents are written when they accompany logs (type mixed or consent-aware), in the same format as the logs. Accepts the same values as output. It is rejected for other runs, type consent writes its consents to output",
+			EnvVar: "CONSENT_OUTPUT",
+		},
+		cli.StringFlag{
+			Name:   "label-output",
+			Usage:  "The `file` to which the compliance label of every log is written as json (only applicable with consent-aware). On kafka the labels are also added as record headers",
+			EnvVar: "LABEL_OUTPUT",
+		},
 		cli.StringSliceFlag{
 			Name:   "kafka-broker-list",
 			Usage:  "A comma separated list of `brokers` used to bootstrap the connection to a kafka cluster. eg: 127.0.0.1,172.10.50.4",
@@ -163,6 +438,17 @@ var generateCommand = cli.Command{
 			Usage:  "The name of the topic on which logs will be produced.",
 			EnvVar: "KAFKA_TOPIC",
 		},
+		cli.StringFlag{
+			Name:   "kafka-consent-topic",
+			Value:  "policies",
+			Usage:  "The name of the topic on which consents will be produced when they accompany logs (type mixed or consent-aware) and no consent-output is set.",
+			EnvVar: "KAFKA_CONSENT_TOPIC",
+		},
+		cli.BoolFlag{
+			Name:   "kafka-tls",
+			Usage:  "Set to connect to kafka over TLS. This is implied when any of the kafka certificate files is given",
+			EnvVar: "KAFKA_TLS",
+		},
 		cli.StringFlag{
 			Name:   "kafka-cert-file",
 			Usage:  "The `path` to a certificate file used for client authentication to kafka.",
@@ -175,28 +461,194 @@ var generateCommand = cli.Command{
 		},
 		cli.StringFlag{
 			Name:   "kafka-ca-file",
-			Usage:  "The `path` to a ca file used for client authentication to kafka.",
+			Usage:  "The `path` to a ca file used to verify the certificate of the kafka brokers. The system roots are used when it is not set.",
 			EnvVar: "KAFKA_CA_FILE",
 		},
-		cli.BoolFlag{
+		cli.BoolTFlag{
 			Name:   "kafka-verify-ssl",
-			Usage:  "Set to verify the SSL chain when connecting to kafka",
+			Usage:  "Verify the SSL chain when connecting to kafka. Use --kafka-verify-ssl=false to disable",
 			EnvVar: "KAFKA_VERIFY_SSL",
 		},
+		cli.StringFlag{
+			Name:   "kafka-tls-server-name",
+			Usage:  "The `name` used to verify the certificate of the kafka brokers, instead of their address",
+			EnvVar: "KAFKA_TLS_SERVER_NAME",
+		},
+		cli.StringFlag{
+			Name:   "kafka-tls-min-version",
+			Value:  "1.2",
+			Usage:  "The minimum TLS `version` used when connecting to kafka (1.0, 1.1, 1.2 or 1.3)",
+			EnvVar: "KAFKA_TLS_MIN_VERSION",
+		},
+		cli.StringFlag{
+			Name:   "kafka-sasl-mechanism",
+			Usage:  "The SASL `mechanism` used to authenticate to kafka (PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512). SASL is disabled when it is empty",
+			EnvVar: "KAFKA_SASL_MECHANISM",
+		},
+		cli.StringFlag{
+			Name:   "kafka-sasl-username",
+			Usage:  "The `username` used for SASL authentication to kafka",
+			EnvVar: "KAFKA_SASL_USERNAME",
+		},
+		cli.StringFlag{
+			Name:   "kafka-sasl-password",
+			Usage:  "The `password` used for SASL authentication to kafka",
+			EnvVar: "KAFKA_SASL_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:   "kafka-sasl-password-file",
+			Usage:  "The `path` to a file containing the password used for SASL authentication to kafka, as an alternative to kafka-sasl-password",
+			EnvVar: "KAFKA_SASL_PASSWORD_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "kafka-async",
+			Usage:  "Set to produce messages asynchronously in batches, instead of waiting for each message to be acknowledged",
+			EnvVar: "KAFKA_ASYNC",
+		},
+		cli.IntFlag{
+			Name:   "kafka-flush-messages",
+			Usage:  "The `number` of messages which triggers sending a batch (only applicable with kafka-async)",
+			EnvVar: "KAFKA_FLUSH_MESSAGES",
+		},
+		cli.IntFlag{
+			Name:   "kafka-flush-bytes",
+			Usage:  "The `number` of bytes which triggers sending a batch (only applicable with kafka-async)",
+			EnvVar: "KAFKA_FLUSH_BYTES",
+		},
+		cli.DurationFlag{
+			Name:   "kafka-flush-frequency",
+			Usage:  "The `interval` at which batches are sent (only applicable with kafka-async)",
+			EnvVar: "KAFKA_FLUSH_FREQUENCY",
+		},
+		cli.StringFlag{
+			Name:   "kafka-compression",
+			Value:  "none",
+			Usage:  "The compression `codec` used for messages (none, gzip, snappy or lz4)",
+			EnvVar: "KAFKA_COMPRESSION",
+		},
+		cli.StringFlag{
+			Name:   "kafka-required-acks",
+			Value:  "all",
+			Usage:  "The `level` of acknowledgement required from the brokers (none, local or all)",
+			EnvVar: "KAFKA_REQUIRED_ACKS",
+		},
+		cli.IntFlag{
+			Name:   "kafka-max-in-flight",
+			Value:  5,
+			Usage:  "The maximum `number` of unacknowledged requests to a single broker",
+			EnvVar: "KAFKA_MAX_IN_FLIGHT",
+		},
+		cli.BoolFlag{
+			Name:   "append",
+			Usage:  "Set to append to existing file outputs instead of refusing to overwrite them",
+			EnvVar: "APPEND",
+		},
+		cli.BoolFlag{
+			Name:   "force",
+			Usage:  "Set to overwrite existing file outputs",
+			EnvVar: "FORCE",
+		},
+		cli.DurationFlag{
+			Name:   "flush-interval",
+			Usage:  "The `interval` at which buffered file and stdout outputs are written out, 0 to only write them out when full",
+			Value:  time.Second,
+			EnvVar: "FLUSH_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "rotate-size",
+			Usage:  "The `size` (eg: 100MB) after which a file output starts a new segment",
+			EnvVar: "ROTATE_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "rotate-events",
+			Usage:  "The `number` of events after which a file output starts a new segment",
+			EnvVar: "ROTATE_EVENTS",
+		},
+		cli.DurationFlag{
+			Name:   "rotate-interval",
+			Usage:  "The `duration` after which a file output starts a new segment. Segments are closed once they are this old, even when no more events are written",
+			EnvVar: "ROTATE_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "rotate-compression",
+			Value:  "none",
+			Usage:  "The `codec` used to compress closed segments of a rotated file output (none, gzip, lz4 or zstd)",
+			EnvVar: "ROTATE_COMPRESSION",
+		},
+		cli.IntFlag{
+			Name:   "rotate-keep",
+			Usage:  "The maximum `number` of segments of a rotated file output to retain, older ones are deleted (default: all)",
+			EnvVar: "ROTATE_KEEP",
+		},
+		cli.StringSliceFlag{
+			Name:   "http-header",
+			Usage:  "A `header` formatted as 'Name: value' added to every request of an http output. Can be repeated",
+			EnvVar: "HTTP_HEADER",
+		},
+		cli.StringFlag{
+			Name:   "http-auth-token",
+			Usage:  "The bearer `token` used to authenticate to an http output",
+			EnvVar: "HTTP_AUTH_TOKEN",
+		},
+		cli.DurationFlag{
+			Name:   "http-timeout",
+			Value:  10 * time.Second,
+			Usage:  "The `duration` after which a request to an http output is abandoned",
+			EnvVar: "HTTP_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "http-retries",
+			Value:  3,
+			Usage:  "The `number` of times a failed request to an http output is retried",
+			EnvVar: "HTTP_RETRIES",
+		},
+		cli.DurationFlag{
+			Name:   "http-retry-backoff",
+			Value:  100 * time.Millisecond,
+			Usage:  "The `duration` before the first retry of a request to an http output, which doubles for every next retry",
+			EnvVar: "HTTP_RETRY_BACKOFF",
+		},
+		cli.IntFlag{
+			Name:   "http-concurrency",
+			Value:  1,
+			Usage:  "The `number` of concurrent requests to an http output",
+			EnvVar: "HTTP_CONCURRENCY",
+		},
+		cli.IntFlag{
+			Name:   "http-batch-size",
+			Value:  1,
+			Usage:  "The `number` of events sent in a single request to an http output",
+			EnvVar: "HTTP_BATCH_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "http-batch-format",
+			Value:  "json",
+			Usage:  "The `format` of a batch of json or JSON-LD events sent to an http output (json array or ndjson). Batches in the RDF formats are always newline delimited",
+			EnvVar: "HTTP_BATCH_FORMAT",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		rate := c.Duration("rate")
 		num := c.Int("num")
 
-		// Ensure rate and num are using sane combinations
-		if rate == 0 && num <= 0 {
-			return cli.NewExitError("Streaming (num <= 0) must be used with a non-zero rate duration", 1)
+		// Parse out the eps flag, which is an alternative way to express the rate
+		if c.Float64("eps") < 0 {
+			return cli.NewExitError("eps should not be negative", 1)
+		}
+		if c.Float64("eps") > 0 {
+			if rate != 0 {
+				return cli.NewExitError("Only one of rate and eps can be used", 1)
+			}
+			rate = time.Duration(float64(time.Second) / c.Float64("eps"))
 		}
 
+		// Parse out the seed flag, the default config is derived from it as well
+		seeded := c.IsSet("seed")
+		r := newRand(c.Int64("seed"), seeded)
+
 		// Parse out the configuration should there be any
 		configFlag := c.String("config")
-		// This only makes a shallow copy, but the defaultConfig is never reused anyway, so it's not causing any issues for now
-		conf := defaultConfig
+		conf := makeDefaultConfig(r)
 		if configFlag != "" {
 			rawConfig, err := ioutil.ReadFile(configFlag)
 			if err != nil {
@@ -208,96 +660,438 @@ var generateCommand = cli.Command{
 			}
 		}
 
-		// Parse the output flag and kafka options
-		var kafkaProducer sarama.SyncProducer
-		var output *os.File
-		kafkaTopic := c.String("kafka-topic")
-		if c.String("output") == "kafka" {
-			fmt.Println("[INFO] Writing logs to kafka")
-			var err error
-			kafkaProducer, err = createKafkaProducer(kafkaConfig{
-				BrokerList: c.StringSlice("kafka-broker-list"),
-				CertFile:   c.String("kafka-cert-file"),
-				KeyFile:    c.String("kafka-key-file"),
-				CaFile:     c.String("kafka-ca-file"),
-				VerifySsl:  c.Bool("kafka-verify-ssl"),
-			})
+		// The base IRIs of the config are used by all RDF formats
+		if conf.IRIs != nil {
+			if err := setResourceNamespaces(*conf.IRIs); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+		}
+
+		// Parse out the traffic flags, which take precedence over the traffic section of the config
+		traffic := traffic{}
+		if conf.Traffic != nil {
+			traffic = *conf.Traffic
+		}
+		if c.String("arrivals") != "" {
+			traffic.Arrivals = c.String("arrivals")
+		}
+		if len(c.StringSlice("burst")) > 0 {
+			traffic.Bursts = nil
+			for _, value := range c.StringSlice("burst") {
+				b, err := parseBurst(value)
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+				traffic.Bursts = append(traffic.Bursts, b)
+			}
+		}
+
+		// Parse out the backfill flags
+		// Seeded and backfill runs use a simulated clock, so their timestamps do not depend on the wall clock.
+		// The arrival model then spaces out the timestamps, while events are emitted at a constant rate.
+		var sim *simClock
+		var done func() bool
+		clock := time.Now
+		pace, err := newArrivals(traffic.Arrivals, r, rate, 0, traffic)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		simulated := seeded || c.String("start-time") != ""
+		// In real time poisson and diurnal arrivals are spread around the rate, without one they would all be 0 apart
+		if !simulated && rate <= 0 && (traffic.Arrivals == "poisson" || traffic.Arrivals == "diurnal") {
+			return cli.NewExitError(fmt.Sprintf("arrivals %s requires a rate or eps larger than 0, unless the timestamps are simulated (seed or start-time)", traffic.Arrivals), 1)
+		}
+		if simulated {
+			interval := c.Duration("event-interval")
+			if interval == 0 {
+				interval = rate
+			}
+			if interval == 0 {
+				interval = time.Millisecond
+			}
+			// A jitter larger than the interval would be cut off at 0, which shifts the mean interval
+			if jitter := c.Duration("event-jitter"); jitter < 0 || jitter > interval {
+				return cli.NewExitError(fmt.Sprintf("event-jitter should be between 0 and the event-interval (%s). Received %s", interval, jitter), 1)
+			}
+			model, err := newArrivals(traffic.Arrivals, r, interval, c.Duration("event-jitter"), traffic)
 			if err != nil {
 				return cli.NewExitError(err.Error(), 1)
 			}
-			defer kafkaProducer.Close()
-			fmt.Printf("[INFO] Successfully connected to kafka cluster at %s\n", c.StringSlice("kafka-broker-list"))
-		} else {
-			var err error
-			output, err = getOutput(c.String("output"))
+			sim = &simClock{now: seedEpoch, arrivals: model}
+			pace = constantArrivals{interval: rate}
+			clock = sim.tick
+			done = sim.done
+		}
+		if c.String("start-time") != "" {
+			start, err := parseTime(c.String("start-time"))
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			sim.now = start
+		}
+		if c.String("end-time") != "" {
+			if c.String("start-time") == "" {
+				return cli.NewExitError("end-time can only be used together with start-time", 1)
+			}
+			end, err := parseTime(c.String("end-time"))
 			if err != nil {
 				return cli.NewExitError(err.Error(), 1)
 			}
-			defer output.Close()
+			if end.Before(sim.now) {
+				return cli.NewExitError("end-time should not be before start-time", 1)
+			}
+			sim.end = end
 		}
 
-		// Parse out the type flag (log or consent)
+		// Ensure rate and num are using sane combinations
+		if rate == 0 && num <= 0 && (sim == nil || sim.end.IsZero()) && c.Duration("duration") <= 0 {
+			return cli.NewExitError("Streaming (num <= 0) must be used with a non-zero rate duration, a duration or an end-time", 1)
+		}
+
+		// Parse out the generator options
+		gen := &generator{
+			rand:          r,
+			clock:         clock,
+			config:        conf,
+			maxSize:       c.Int("max-policy-size"),
+			violationRate: c.Float64("violation-rate"),
+			consentRatio:  c.Int("consent-ratio"),
+
+			lifecycle:      c.Bool("consent-lifecycle"),
+			withdrawalRate: c.Float64("withdrawal-rate"),
+			consentTTL:     c.Duration("consent-ttl"),
+		}
+		if gen.maxSize < 1 {
+			return cli.NewExitError("max-policy-size should be at least 1", 1)
+		}
+		if gen.violationRate < 0 || gen.violationRate > 1 {
+			return cli.NewExitError("violation-rate should be between 0 and 1", 1)
+		}
+		if gen.withdrawalRate < 0 || gen.withdrawalRate > 1 {
+			return cli.NewExitError("withdrawal-rate should be between 0 and 1", 1)
+		}
+
+		workers := c.Int("workers")
+		if workers < 1 {
+			return cli.NewExitError("workers should be at least 1", 1)
+		}
+
+		// Parse out the type flag (log, consent or mixed)
 		eventType := c.String("type")
-		var producer func(config, int) message
-		var ttlTemplate *template.Template
-		if eventType == "log" {
-			producer = makeLog
-			ttlTemplate = getLogTTLTemplate()
-		} else if eventType == "consent" {
-			producer = makeConsent
-			ttlTemplate = getConsentTTLTemplate()
-		} else {
-			return cli.NewExitError(fmt.Sprintf("type should be oneOf ['log', 'consent']"), 1)
+		consentAware := c.Bool("consent-aware")
+		if consentAware && eventType != "log" {
+			return cli.NewExitError("consent-aware can only be used with type log", 1)
+		}
+		if c.String("label-output") != "" && !consentAware {
+			return cli.NewExitError("label-output can only be used with consent-aware", 1)
+		}
+		// Consents of type consent are the events themselves, so they are written to the outputs
+		if c.String("consent-output") != "" && eventType != "mixed" && !consentAware {
+			return cli.NewExitError("consent-output can only be used with type mixed or consent-aware", 1)
 		}
+		var producer func() message
+		switch eventType {
+		case "log":
+			producer = gen.makeLog
+			if consentAware {
+				producer = gen.makeLabelledLog
+			}
+		case "consent":
+			producer = gen.nextConsent
+		case "mixed":
+			if gen.consentRatio <= 0 {
+				return cli.NewExitError("consent-ratio should be larger than 0", 1)
+			}
+			producer = gen.makeMixed
+		default:
+			return cli.NewExitError(fmt.Sprintf("type should be oneOf ['log', 'consent', 'mixed']"), 1)
+		}
+
+		// The metrics of the kafka producers are only collected when they are exported
+		var registry gometrics.Registry
+		if c.String("metrics-addr") != "" {
+			registry = gometrics.NewRegistry()
+		}
+
+		// Stop generating on SIGINT or SIGTERM, everything generated so far is still delivered
+		// The outputs stop retrying failed deliveries then
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		defer cancelOnSignal(cancel)()
+
+		// Parse the output flag and kafka options
+		options := sinkOptions{
+			kafka: kafkaConfig{
+				BrokerList:    c.StringSlice("kafka-broker-list"),
+				TLS:           c.Bool("kafka-tls"),
+				CertFile:      c.String("kafka-cert-file"),
+				KeyFile:       c.String("kafka-key-file"),
+				CaFile:        c.String("kafka-ca-file"),
+				VerifySsl:     c.BoolT("kafka-verify-ssl"),
+				TLSServerName: c.String("kafka-tls-server-name"),
+				TLSMinVersion: c.String("kafka-tls-min-version"),
 
-		// Parse out the max-policy-size flag
-		maxSize := c.Int("max-policy-size")
+				SASLMechanism:    c.String("kafka-sasl-mechanism"),
+				SASLUsername:     c.String("kafka-sasl-username"),
+				SASLPassword:     c.String("kafka-sasl-password"),
+				SASLPasswordFile: c.String("kafka-sasl-password-file"),
 
-		// Parse out the format flag (json or ttl)
+				Async:          c.Bool("kafka-async"),
+				FlushMessages:  c.Int("kafka-flush-messages"),
+				FlushBytes:     c.Int("kafka-flush-bytes"),
+				FlushFrequency: c.Duration("kafka-flush-frequency"),
+				Compression:    c.String("kafka-compression"),
+				RequiredAcks:   c.String("kafka-required-acks"),
+				MaxInFlight:    c.Int("kafka-max-in-flight"),
+				MetricRegistry: registry,
+			},
+			kafkaTopic: c.String("kafka-topic"),
+			http: httpConfig{
+				Headers:      c.StringSlice("http-header"),
+				AuthToken:    c.String("http-auth-token"),
+				Timeout:      c.Duration("http-timeout"),
+				Retries:      c.Int("http-retries"),
+				RetryBackoff: c.Duration("http-retry-backoff"),
+				Concurrency:  c.Int("http-concurrency"),
+				BatchSize:    c.Int("http-batch-size"),
+				BatchFormat:  c.String("http-batch-format"),
+			},
+			rotate: rotateConfig{
+				Events:      c.Int("rotate-events"),
+				Interval:    c.Duration("rotate-interval"),
+				Compression: c.String("rotate-compression"),
+				Keep:        c.Int("rotate-keep"),
+			},
+			append:        c.Bool("append"),
+			force:         c.Bool("force"),
+			flushInterval: c.Duration("flush-interval"),
+			shutdown:      ctx.Done(),
+		}
+		options.rotate.Size, err = parseSize(c.String("rotate-size"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		// Every event is written to all outputs, each in its own format (eg: json or ttl)
 		format := c.String("format")
-		var serializer func(interface{}) ([]byte, error)
-		if format == "json" {
-			serializer = json.Marshal
-		} else if format == "ttl" {
-			serializer = createTTLMarshal(ttlTemplate)
+		serializers := serializerOptions{
+			graph: c.String("graph"),
+			avro: avroConfig{
+				Registry:        c.String("schema-registry"),
+				Register:        c.BoolT("schema-register"),
+				LogSchemaID:     c.Int("log-schema-id"),
+				ConsentSchemaID: c.Int("consent-schema-id"),
+				Types:           avroTypes(eventType, consentAware),
+			},
+		}
+		switch serializers.graph {
+		case "event", "user", "process":
+		default:
+			return cli.NewExitError(fmt.Sprintf("graph should be oneOf ['event', 'user', 'process']. Received %s", serializers.graph), 1)
+		}
+		outputs := []*target{}
+		outputFlags := c.StringSlice("output")
+		if len(outputFlags) == 0 {
+			// Not an EnvVar of the flag, which would split kafka URIs with several brokers on their commas
+			outputFlags = strings.Fields(os.Getenv("OUTPUT"))
+		}
+		if len(outputFlags) == 0 {
+			outputFlags = []string{""}
+		}
+		for _, outputFlag := range outputFlags {
+			output, err := openTarget(outputFlag, format, serializers, options)
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			defer abortSink(output.sink)
+			outputs = append(outputs, output)
+		}
+
+		// Consents which accompany logs (type mixed or consent-aware) are written to the consent-output,
+		// or to the kafka-consent-topic of every kafka output
+		consentOutputs := []*target{}
+		if c.String("consent-output") != "" {
+			consentOutput, err := openTarget(c.String("consent-output"), format, serializers, options)
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			defer abortSink(consentOutput.sink)
+			consentOutputs = append(consentOutputs, consentOutput)
 		} else {
-			return cli.NewExitError(fmt.Sprintf("format should be oneOf ['json', 'ttl']. Recieved %s", format), 1)
+			for _, output := range outputs {
+				if kafkaOutput, ok := output.sink.(*kafkaSink); ok {
+					consentOutput := *output
+					consentOutput.sink = kafkaOutput.withTopic(c.String("kafka-consent-topic"))
+					consentOutputs = append(consentOutputs, &consentOutput)
+				}
+			}
+		}
+		if eventType == "mixed" && len(consentOutputs) == 0 {
+			return cli.NewExitError("type mixed requires a consent-output when not writing to kafka", 1)
+		}
+		if consentAware && len(consentOutputs) == 0 {
+			return cli.NewExitError("consent-aware requires a consent-output when not writing to kafka", 1)
 		}
 
-		// Create the channel and start emitting messages
-		ch := make(chan message)
-		go generateLog(conf, num, rate, maxSize, producer, ch)
+		// Parse out the label-output flag
+		var labelOutput *outputFile
+		if c.String("label-output") != "" {
+			labelOutput, err = getOutput(c.String("label-output"), c.Bool("append"), c.Bool("force"))
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			labelOutput.flushEvery(c.Duration("flush-interval"))
+			defer labelOutput.Close()
+		}
 
-		// For each message call the serializer and write to the output
-		if kafkaProducer != nil {
-			for log := range ch {
-				b, err := serializer(log.Value)
-				if err != nil {
-					return cli.NewExitError(err.Error(), 1)
+		// destinations returns the outputs matching the type of a message
+		destinations := func(msg message) []*target {
+			if _, ok := msg.Value.(policy); ok && eventType != "consent" {
+				return consentOutputs
+			}
+			return outputs
+		}
+
+		// serialize serializes a message once for every format of its outputs
+		// It is safe to call it from several go-routines
+		serialize := func(msg message) (map[string][]byte, error) {
+			serialized := map[string][]byte{}
+			for _, destination := range destinations(msg) {
+				if _, ok := serialized[destination.format]; ok {
+					continue
 				}
-				_, _, err = kafkaProducer.SendMessage(&sarama.ProducerMessage{
-					Topic: kafkaTopic,
-					Key:   sarama.StringEncoder(log.Key),
-					Value: sarama.StringEncoder(b),
-				})
+				b, err := destination.serialize(msg.Value)
 				if err != nil {
-					return cli.NewExitError(err.Error(), 1)
+					return nil, err
 				}
+				serialized[destination.format] = b
 			}
-			fmt.Printf("[INFO] Done writing %d messages to kafka\n", c.Int("num"))
-		} else {
-			for log := range ch {
-				b, err := serializer(log.Value)
+			return serialized, nil
+		}
+
+		// write writes a serialized message to all outputs matching its type, returning the number of bytes written
+		write := func(msg message, serialized map[string][]byte) (int, error) {
+			written := 0
+			for _, destination := range destinations(msg) {
+				b := serialized[destination.format]
+				err := destination.sink.write(record{Key: msg.Key, Value: b, Label: msg.Label})
 				if err != nil {
-					return cli.NewExitError(err.Error(), 1)
+					return written, err
+				}
+				written += len(b)
+			}
+			return written, writeLabel(labelOutput, msg.Label)
+		}
+
+		send := func(msg message) (int, error) {
+			serialized, err := serialize(msg)
+			if err != nil {
+				return 0, err
+			}
+			return write(msg, serialized)
+		}
+
+		// Report the achieved rate on stderr, so it never mixes with events written to stdout
+		target := 0.0
+		if rate > 0 {
+			target = float64(time.Second) / float64(rate)
+		}
+		stats := newMeter(target)
+		if c.Duration("report-interval") > 0 {
+			stopReporting := make(chan struct{})
+			defer close(stopReporting)
+			go stats.reportEvery(c.Duration("report-interval"), os.Stderr, stopReporting)
+		}
+		if c.String("metrics-addr") != "" {
+			handler := &metricsHandler{stats: stats, registry: registry}
+			// Outputs sharing a kafka producer should only be counted once
+			seen := map[interface{}]bool{}
+			for _, output := range append(consentOutputs, outputs...) {
+				var sender interface{} = output.sink
+				if kafkaOutput, ok := output.sink.(*kafkaSink); ok {
+					sender = kafkaOutput.sender
 				}
-				_, err = fmt.Fprintf(output, "%s\n", b)
+				if counter, ok := sender.(failureCounter); ok && !seen[sender] {
+					seen[sender] = true
+					handler.failures = append(handler.failures, counter)
+				}
+			}
+			server, err := serveMetrics(c.String("metrics-addr"), handler)
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			defer server.Close()
+		}
+
+		// In consent aware mode, the consents are created up front
+		if consentAware {
+			for _, consent := range gen.makeConsents() {
+				start := time.Now()
+				n, err := send(consent)
 				if err != nil {
+					stats.fail()
+					stats.summary(os.Stderr)
 					return cli.NewExitError(err.Error(), 1)
 				}
+				stats.mark(consent.eventType(), n, time.Since(start))
 			}
 		}
 
+		if c.Duration("duration") > 0 {
+			ctx, cancel = context.WithTimeout(ctx, c.Duration("duration"))
+			defer cancel()
+		}
+
+		// Create the channel and start emitting messages, which are serialized by the workers
+		ch := make(chan message)
+		go generateLog(ctx, num, &pacer{arrivals: pace}, producer, done, ch)
+		results := serializeInParallel(workers, ch, serialize)
+
+		// Write every message to the outputs, in the order in which they were generated
+		for result := range results {
+			<-result.done
+			start := time.Now()
+			n, err := 0, result.err
+			if err == nil {
+				n, err = write(result.msg, result.values)
+			}
+			if err != nil {
+				cancel()
+				// Let the generator and the workers finish
+				for range results {
+				}
+				stats.fail()
+				stats.summary(os.Stderr)
+				return cli.NewExitError(err.Error(), 1)
+			}
+			stats.mark(result.msg.eventType(), n, time.Since(start))
+		}
+
+		// Deliver everything (eg: to an asynchronous kafka producer) before reporting
+		// All outputs are closed, even when one of them fails, and the first error is returned
+		var closeErr error
+		for _, output := range append(consentOutputs, outputs...) {
+			if err = output.sink.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "[ERROR] %s\n", err)
+				stats.fail()
+				if closeErr == nil {
+					closeErr = err
+				}
+			}
+		}
+		if labelOutput != nil {
+			if err = labelOutput.Commit(); err != nil {
+				fmt.Fprintf(os.Stderr, "[ERROR] %s\n", err)
+				stats.fail()
+				if closeErr == nil {
+					closeErr = err
+				}
+			}
+		}
+		stats.summary(os.Stderr)
+		if closeErr != nil {
+			return cli.NewExitError(closeErr.Error(), 1)
+		}
+
 		return nil
 	},
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// runGenerate runs the generate command with args, without exiting the test on an error.
+func runGenerate(args ...string) error {
+	exiter := cli.OsExiter
+	cli.OsExiter = func(int) {}
+	defer func() { cli.OsExiter = exiter }()
+	app := cli.NewApp()
+	app.Commands = []cli.Command{generateCommand}
+	return app.Run(append([]string{"slg", "generate"}, args...))
+}
+
+func TestSeededRunsAreReproducible(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		// outputs are the files written besides the output
+		outputs []string
+	}{
+		{name: "json", args: []string{"--format", "json"}},
+		{name: "ttl", args: []string{"--format", "ttl"}},
+		{name: "nq", args: []string{"--format", "nq"}},
+		{name: "jsonld", args: []string{"--format", "jsonld"}},
+		{
+			name:    "consent aware",
+			args:    []string{"--consent-aware", "--violation-rate", "0.2", "--consent-output", "consents.json", "--label-output", "labels.json"},
+			outputs: []string{"consents.json", "labels.json"},
+		},
+		{name: "mixed", args: []string{"-t", "mixed", "--consent-lifecycle", "--consent-output", "consents.json"}, outputs: []string{"consents.json"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "slg-seed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			var expected map[string][]byte
+			for run, workers := range []int{1, 1, 4} {
+				runDir := filepath.Join(dir, strconv.Itoa(run))
+				if err := os.Mkdir(runDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				args := []string{"--num", "500", "--seed", "42", "--workers", strconv.Itoa(workers), "--output", filepath.Join(runDir, "output")}
+				for _, arg := range test.args {
+					for _, output := range test.outputs {
+						if arg == output {
+							arg = filepath.Join(runDir, output)
+						}
+					}
+					args = append(args, arg)
+				}
+				if err := runGenerate(args...); err != nil {
+					t.Fatal(err)
+				}
+
+				actual := map[string][]byte{}
+				for _, output := range append([]string{"output"}, test.outputs...) {
+					if actual[output], err = ioutil.ReadFile(filepath.Join(runDir, output)); err != nil {
+						t.Fatal(err)
+					}
+					if len(actual[output]) == 0 {
+						t.Fatalf("expected %s to contain events", output)
+					}
+				}
+				if expected == nil {
+					expected = actual
+					continue
+				}
+				for output, content := range expected {
+					if !bytes.Equal(actual[output], content) {
+						t.Errorf("expected run %d (%d workers) to write the same %s as the first run", run+1, workers, output)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type httpConfig struct {
+	Headers      []string
+	AuthToken    string
+	Timeout      time.Duration
+	Retries      int
+	RetryBackoff time.Duration
+	Concurrency  int
+	BatchSize    int
+	BatchFormat  string
+}
+
+// httpContentTypes maps the serialization formats onto the content type of a request with a single event.
+var httpContentTypes = map[string]string{
+	"json":            "application/json",
+	"jsonld":          "application/ld+json",
+	"jsonld-expanded": "application/ld+json",
+	"ttl":             "text/turtle",
+	"trig":            "application/trig",
+	"nt":              "application/n-triples",
+	"nq":              "application/n-quads",
+}
+
+// httpSink POSTs records to an HTTP endpoint, either one by one or in batches.
+// Batches are sent by a pool of workers, writing only waits for the endpoint once all workers are busy
+// and as many batches are queued as there are workers.
+// Failed requests are counted and reported when the sink is closed.
+// Batches are sent as a json array, or newline delimited when delimited is set.
+// With ndjson set every record ends with a newline, single events included.
+type httpSink struct {
+	client      *http.Client
+	endpoint    string
+	headers     http.Header
+	config      httpConfig
+	delimited   bool
+	ndjson      bool
+	shutdown    <-chan struct{}
+	batch       [][]byte
+	batches     chan [][]byte
+	inFlight    sync.WaitGroup
+	workers     sync.WaitGroup
+	requests    int64
+	failures    int64
+	lastFailure atomic.Value
+	once        sync.Once
+}
+
+func (s *httpSink) failed() int64 {
+	return atomic.LoadInt64(&s.failures)
+}
+
+// openHTTPSink opens a sink for an http:// or https:// URI.
+func openHTTPSink(u *url.URL, options sinkOptions) (sink, error) {
+	config := options.http
+	if config.Retries < 0 {
+		return nil, fmt.Errorf("http-retries should not be negative. Received %d", config.Retries)
+	}
+	if config.BatchSize < 1 {
+		return nil, fmt.Errorf("http-batch-size should be at least 1. Received %d", config.BatchSize)
+	}
+	if config.Concurrency < 1 {
+		return nil, fmt.Errorf("http-concurrency should be at least 1. Received %d", config.Concurrency)
+	}
+
+	format := options.format
+	if format == "" {
+		format = "json"
+	}
+	contentType, ok := httpContentTypes[format]
+	if !ok {
+		return nil, fmt.Errorf("The %s format can not be sent to an http output", format)
+	}
+	// Batches of json events follow the batch format, the RDF formats are simply concatenated line by line
+	isJSON := format == "json" || strings.HasPrefix(format, "jsonld")
+	delimited := !isJSON
+	ndjson := false
+	switch config.BatchFormat {
+	case "", "json":
+		config.BatchFormat = "json"
+	case "ndjson":
+		if isJSON {
+			contentType = "application/x-ndjson"
+			delimited = true
+			ndjson = true
+		}
+	default:
+		return nil, fmt.Errorf("http-batch-format should be oneOf ['json', 'ndjson']. Received %s", config.BatchFormat)
+	}
+	headers := http.Header{}
+	headers.Set("Content-Type", contentType)
+	if config.AuthToken != "" {
+		headers.Set("Authorization", "Bearer "+config.AuthToken)
+	}
+	for _, header := range config.Headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("An http header should be formatted as 'Name: value'. Received %s", header)
+		}
+		headers.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	s := &httpSink{
+		client:    &http.Client{Timeout: config.Timeout},
+		endpoint:  u.String(),
+		headers:   headers,
+		config:    config,
+		delimited: delimited,
+		ndjson:    ndjson,
+		shutdown:  options.shutdown,
+		batches:   make(chan [][]byte, config.Concurrency),
+	}
+	s.workers.Add(config.Concurrency)
+	for i := 0; i < config.Concurrency; i++ {
+		go s.work()
+	}
+	return s, nil
+}
+
+func (s *httpSink) write(r record) error {
+	s.batch = append(s.batch, r.Value)
+	if len(s.batch) >= s.config.BatchSize {
+		s.enqueue()
+	}
+	return nil
+}
+
+// enqueue hands the current batch to the workers.
+func (s *httpSink) enqueue() {
+	if len(s.batch) == 0 {
+		return
+	}
+	s.inFlight.Add(1)
+	s.batches <- s.batch
+	s.batch = nil
+}
+
+// flush sends the last, partial batch and waits for all batches to be sent.
+func (s *httpSink) flush() {
+	s.enqueue()
+	s.inFlight.Wait()
+}
+
+func (s *httpSink) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.flush()
+		close(s.batches)
+		s.workers.Wait()
+		fmt.Fprintf(os.Stderr, "[INFO] Sent %d requests to %s, %d failed\n", atomic.LoadInt64(&s.requests), s.endpoint, atomic.LoadInt64(&s.failures))
+		if lastFailure, ok := s.lastFailure.Load().(error); ok {
+			err = fmt.Errorf("Failed to send %d requests to %s, last error: %s", atomic.LoadInt64(&s.failures), s.endpoint, lastFailure)
+		}
+	})
+	return err
+}
+
+// work sends the batches it receives until the channel is closed.
+// The function is meant to run as a go-routine.
+func (s *httpSink) work() {
+	defer s.workers.Done()
+	for batch := range s.batches {
+		atomic.AddInt64(&s.requests, 1)
+		err := s.post(s.body(batch))
+		if err != nil {
+			atomic.AddInt64(&s.failures, 1)
+			s.lastFailure.Store(err)
+			fmt.Fprintf(os.Stderr, "[WARN] %s\n", err)
+		}
+		s.inFlight.Done()
+	}
+}
+
+// body renders a batch as a request body.
+// A single event is sent as is (as a line in ndjson), larger batches as a json array or newline delimited.
+func (s *httpSink) body(batch [][]byte) []byte {
+	if s.config.BatchSize == 1 && !s.ndjson {
+		return batch[0]
+	}
+	if s.delimited {
+		return append(bytes.Join(batch, []byte("\n")), '\n')
+	}
+	return append(append([]byte("["), bytes.Join(batch, []byte(","))...), ']')
+}
+
+// post sends body to the endpoint, retrying failed requests with an exponential backoff.
+// Network errors, 429 and 5xx responses are retried, other non-2xx responses fail immediately.
+// Retrying stops when the run is shut down.
+func (s *httpSink) post(body []byte) error {
+	backoff := s.config.RetryBackoff
+	var err error
+	for attempt := 0; attempt <= s.config.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-s.shutdown:
+				return fmt.Errorf("Stopped retrying on shutdown: %s", err)
+			}
+			backoff *= 2
+		}
+		var retry bool
+		retry, err = s.postOnce(body)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// postOnce sends a single request and returns whether it makes sense to retry it when it failed.
+func (s *httpSink) postOnce(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for name, values := range s.headers {
+		req.Header[name] = values
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+	err = errors.New(strings.TrimSpace(fmt.Sprintf("%s responded with %s %s", s.endpoint, res.Status, message)))
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500, err
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testEndpoint records the requests it receives, and responds with the given status codes in turn (200 when they run out).
+type testEndpoint struct {
+	mutex    sync.Mutex
+	statuses []int
+	bodies   []string
+	headers  []http.Header
+}
+
+func (e *testEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.bodies = append(e.bodies, string(body))
+	e.headers = append(e.headers, r.Header)
+	status := http.StatusOK
+	if len(e.statuses) > 0 {
+		status, e.statuses = e.statuses[0], e.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (e *testEndpoint) requests() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return len(e.bodies)
+}
+
+// sendAll writes the values to a new http sink for the server, and returns the error of closing it.
+func sendAll(t *testing.T, server *httptest.Server, options sinkOptions, values ...string) error {
+	// The defaults of the flags
+	if options.http.BatchSize == 0 {
+		options.http.BatchSize = 1
+	}
+	if options.http.Concurrency == 0 {
+		options.http.Concurrency = 1
+	}
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := openHTTPSink(u, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range values {
+		if err := s.write(record{Value: []byte(value)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s.Close()
+}
+
+func TestHTTPSinkRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int
+		fails    bool
+	}{
+		{name: "success", requests: 1},
+		{name: "retry on 503", statuses: []int{503, 503}, requests: 3},
+		{name: "retry on 429", statuses: []int{429}, requests: 2},
+		{name: "no retry on 400", statuses: []int{400}, requests: 1, fails: true},
+		{name: "retries exhausted", statuses: []int{500, 502, 503, 504}, requests: 4, fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			endpoint := &testEndpoint{statuses: test.statuses}
+			server := httptest.NewServer(endpoint)
+			defer server.Close()
+
+			err := sendAll(t, server, sinkOptions{http: httpConfig{Retries: 3, RetryBackoff: time.Millisecond}}, `{"a":1}`)
+			if test.fails && err == nil {
+				t.Error("expected an error")
+			}
+			if !test.fails && err != nil {
+				t.Error(err)
+			}
+			if endpoint.requests() != test.requests {
+				t.Errorf("expected %d requests, got %d", test.requests, endpoint.requests())
+			}
+		})
+	}
+}
+
+func TestHTTPSinkStopsRetryingOnShutdown(t *testing.T) {
+	endpoint := &testEndpoint{statuses: []int{503, 503, 503}}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	shutdown := make(chan struct{})
+	close(shutdown)
+	start := time.Now()
+	err := sendAll(t, server, sinkOptions{http: httpConfig{Retries: 3, RetryBackoff: time.Hour}, shutdown: shutdown}, `{"a":1}`)
+	if err == nil {
+		t.Error("expected an error")
+	}
+	if time.Since(start) > time.Minute {
+		t.Error("expected the backoff to be interrupted")
+	}
+	if endpoint.requests() != 1 {
+		t.Errorf("expected 1 request, got %d", endpoint.requests())
+	}
+}
+
+func TestHTTPSinkBodies(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		config      httpConfig
+		values      []string
+		bodies      []string
+		contentType string
+	}{
+		{
+			name:        "single events",
+			config:      httpConfig{},
+			values:      []string{`{"a":1}`, `{"a":2}`},
+			bodies:      []string{`{"a":1}`, `{"a":2}`},
+			contentType: "application/json",
+		},
+		{
+			name:        "json batches",
+			format:      "json",
+			config:      httpConfig{BatchSize: 2, BatchFormat: "json"},
+			values:      []string{`{"a":1}`, `{"a":2}`, `{"a":3}`},
+			bodies:      []string{`[{"a":1},{"a":2}]`, `[{"a":3}]`},
+			contentType: "application/json",
+		},
+		{
+			name:        "ndjson batches",
+			format:      "json",
+			config:      httpConfig{BatchSize: 2, BatchFormat: "ndjson"},
+			values:      []string{`{"a":1}`, `{"a":2}`, `{"a":3}`},
+			bodies:      []string{"{\"a\":1}\n{\"a\":2}\n", "{\"a\":3}\n"},
+			contentType: "application/x-ndjson",
+		},
+		{
+			name:        "single ndjson events end with a newline",
+			format:      "json",
+			config:      httpConfig{BatchSize: 1, BatchFormat: "ndjson"},
+			values:      []string{`{"a":1}`, `{"a":2}`},
+			bodies:      []string{"{\"a\":1}\n", "{\"a\":2}\n"},
+			contentType: "application/x-ndjson",
+		},
+		{
+			name:        "json-ld",
+			format:      "jsonld",
+			config:      httpConfig{BatchSize: 2, BatchFormat: "json"},
+			values:      []string{`{"@id":"a"}`, `{"@id":"b"}`},
+			bodies:      []string{`[{"@id":"a"},{"@id":"b"}]`},
+			contentType: "application/ld+json",
+		},
+		{
+			name:        "turtle batches are newline delimited",
+			format:      "ttl",
+			config:      httpConfig{BatchSize: 2, BatchFormat: "json"},
+			values:      []string{"<a> <b> <c> .", "<d> <e> <f> ."},
+			bodies:      []string{"<a> <b> <c> .\n<d> <e> <f> .\n"},
+			contentType: "text/turtle",
+		},
+		{
+			name:        "n-triples",
+			format:      "nt",
+			config:      httpConfig{},
+			values:      []string{"<a> <b> <c> ."},
+			bodies:      []string{"<a> <b> <c> ."},
+			contentType: "application/n-triples",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			endpoint := &testEndpoint{}
+			server := httptest.NewServer(endpoint)
+			defer server.Close()
+
+			if err := sendAll(t, server, sinkOptions{http: test.config, format: test.format}, test.values...); err != nil {
+				t.Fatal(err)
+			}
+			if len(endpoint.bodies) != len(test.bodies) {
+				t.Fatalf("expected %d requests, got %d", len(test.bodies), len(endpoint.bodies))
+			}
+			for i, body := range test.bodies {
+				if endpoint.bodies[i] != body {
+					t.Errorf("expected body %q, got %q", body, endpoint.bodies[i])
+				}
+				if contentType := endpoint.headers[i].Get("Content-Type"); contentType != test.contentType {
+					t.Errorf("expected content type %s, got %s", test.contentType, contentType)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPSinkHeaders(t *testing.T) {
+	endpoint := &testEndpoint{}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	config := httpConfig{
+		AuthToken: "secret",
+		Headers:   []string{"X-Source: generator", "Content-Type: application/vnd.special+json"},
+	}
+	if err := sendAll(t, server, sinkOptions{http: config}, `{"a":1}`); err != nil {
+		t.Fatal(err)
+	}
+	headers := endpoint.headers[0]
+	expected := map[string]string{
+		"Authorization": "Bearer secret",
+		"X-Source":      "generator",
+		"Content-Type":  "application/vnd.special+json",
+	}
+	for name, value := range expected {
+		if headers.Get(name) != value {
+			t.Errorf("expected header %s to be %q, got %q", name, value, headers.Get(name))
+		}
+	}
+}
+
+func TestOpenHTTPSinkErrors(t *testing.T) {
+	u := &url.URL{Scheme: "http", Host: "localhost"}
+	invalid := []struct {
+		name    string
+		options sinkOptions
+	}{
+		{name: "unknown batch format", options: sinkOptions{http: httpConfig{BatchFormat: "xml"}}},
+		{name: "malformed header", options: sinkOptions{http: httpConfig{Headers: []string{"no colon"}}}},
+		{name: "binary format", options: sinkOptions{format: "avro"}},
+		{name: "negative retries", options: sinkOptions{http: httpConfig{Retries: -1}}},
+		{name: "empty batches", options: sinkOptions{http: httpConfig{BatchSize: -1}}},
+		{name: "no workers", options: sinkOptions{http: httpConfig{Concurrency: -1}}},
+	}
+	for _, test := range invalid {
+		t.Run(test.name, func(t *testing.T) {
+			// Only the value under test is invalid
+			if test.options.http.BatchSize == 0 {
+				test.options.http.BatchSize = 1
+			}
+			if test.options.http.Concurrency == 0 {
+				test.options.http.Concurrency = 1
+			}
+			if _, err := openHTTPSink(u, test.options); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// jsonldWriter renders the graph of an event as a JSON-LD tree, rooted at the event itself.
+// Nodes which are part of another node are nested in it, and nodes which
+// link to the tree instead (eg: the log of a log entry) are added as @reverse properties.
+// In the compact form, the terms used are collected in the context.
+type jsonldWriter struct {
+	expanded   bool
+	graph      *graph
+	properties map[term][]triple
+	nodes      map[term]map[string]interface{}
+	context    map[string]interface{}
+}
+
+func newJSONLDWriter(g *graph, expanded bool) *jsonldWriter {
+	_, properties := g.subjects()
+	return &jsonldWriter{
+		expanded:   expanded,
+		graph:      g,
+		properties: properties,
+		nodes:      map[term]map[string]interface{}{},
+		context:    map[string]interface{}{},
+	}
+}
+
+// localPart returns the part of an IRI after its last # or /, which is used as term.
+func localPart(iri string) string {
+	return iri[strings.LastIndexAny(iri, "#/")+1:]
+}
+
+// define adds a term for iri to the context and returns it.
+// The compact IRI is returned instead when the term is already used for another IRI.
+func (w *jsonldWriter) define(iri string, definition map[string]interface{}) string {
+	name := localPart(iri)
+	if existing, ok := w.context[name]; ok {
+		id, _ := existing.(string)
+		if definition, ok := existing.(map[string]interface{}); ok {
+			id, _ = definition["@id"].(string)
+		}
+		if id != compactIRI(iri) {
+			return compactIRI(iri)
+		}
+		return name
+	}
+	if definition == nil {
+		w.context[name] = compactIRI(iri)
+		return name
+	}
+	definition["@id"] = compactIRI(iri)
+	w.context[name] = definition
+	return name
+}
+
+// key returns the key for predicate, defining it in the context for the compact form.
+func (w *jsonldWriter) key(predicate string, object term, nested bool) string {
+	if w.expanded {
+		return predicate
+	}
+	definition := map[string]interface{}{}
+	switch object.kind {
+	case iriTerm:
+		if !nested {
+			definition["@type"] = "@id"
+		}
+	case literalTerm:
+		if object.datatype != "" && object.datatype != xsdString {
+			definition["@type"] = compactIRI(object.datatype)
+		}
+	}
+	if w.graph.sets[predicate] {
+		definition["@container"] = "@set"
+	}
+	return w.define(predicate, definition)
+}
+
+// value renders an object which is not nested.
+func (w *jsonldWriter) value(object term) interface{} {
+	switch {
+	case object.kind == literalTerm && w.expanded:
+		value := map[string]interface{}{"@value": object.value}
+		if object.datatype != "" && object.datatype != xsdString {
+			value["@type"] = object.datatype
+		}
+		return value
+	case object.kind == literalTerm:
+		return object.value
+	case w.expanded:
+		return map[string]interface{}{"@id": object.value}
+	default:
+		return compactIRI(object.value)
+	}
+}
+
+// node renders subject with its properties, leaving out the triple skip (if any).
+func (w *jsonldWriter) node(subject term, skip *triple) map[string]interface{} {
+	node := map[string]interface{}{}
+	w.nodes[subject] = node
+	if subject.kind == iriTerm {
+		node["@id"] = subject.value
+	}
+	types := []interface{}{}
+	values := map[string][]interface{}{}
+	sets := map[string]bool{}
+	keys := []string{}
+	for _, t := range w.properties[subject] {
+		if skip != nil && t == *skip {
+			continue
+		}
+		if t.predicate.value == rdfType {
+			if w.expanded {
+				types = append(types, t.object.value)
+			} else {
+				types = append(types, w.define(t.object.value, nil))
+			}
+			continue
+		}
+		nested := w.graph.parts[t.object] && w.nodes[t.object] == nil
+		key := w.key(t.predicate.value, t.object, nested)
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		sets[key] = w.graph.sets[t.predicate.value]
+		if nested {
+			values[key] = append(values[key], w.node(t.object, nil))
+		} else {
+			values[key] = append(values[key], w.value(t.object))
+		}
+	}
+	if len(types) == 1 && !w.expanded {
+		node["@type"] = types[0]
+	} else if len(types) > 0 {
+		node["@type"] = types
+	}
+	for _, key := range keys {
+		if len(values[key]) == 1 && !w.expanded && !sets[key] {
+			node[key] = values[key][0]
+		} else {
+			node[key] = values[key]
+		}
+	}
+	return node
+}
+
+// render renders the graph as a tree rooted at root.
+func (w *jsonldWriter) render(root term) map[string]interface{} {
+	tree := w.node(root, nil)
+	subjects, _ := w.graph.subjects()
+	for _, subject := range subjects {
+		if w.nodes[subject] != nil {
+			continue
+		}
+		for _, t := range w.properties[subject] {
+			target := w.nodes[t.object]
+			if target == nil {
+				continue
+			}
+			key := t.predicate.value
+			if !w.expanded {
+				key = compactIRI(key)
+			}
+			reverse, _ := target["@reverse"].(map[string]interface{})
+			if reverse == nil {
+				reverse = map[string]interface{}{}
+				target["@reverse"] = reverse
+			}
+			t := t
+			node := w.node(subject, &t)
+			if w.expanded {
+				reverse[key] = []interface{}{node}
+			} else {
+				reverse[key] = node
+			}
+			break
+		}
+	}
+	return tree
+}
+
+// createJSONLDMarshal creates a function that renders a log or policy as JSON-LD,
+// either in the compact form with the SPECIAL @context or in the expanded form.
+// The created function is meant to be API compatible with json.Marshal.
+func createJSONLDMarshal(expanded bool) func(v interface{}) ([]byte, error) {
+	return func(v interface{}) ([]byte, error) {
+		switch v.(type) {
+		case log, policy:
+		default:
+			return nil, fmt.Errorf("Can not render %T as JSON-LD", v)
+		}
+		g := newGraph()
+		root := g.describe(v)
+		w := newJSONLDWriter(g, expanded)
+		tree := w.render(root)
+		if expanded {
+			return json.Marshal([]interface{}{tree})
+		}
+		for prefix, namespace := range prefixes {
+			w.context[prefix] = namespace
+		}
+		tree["@context"] = w.context
+		return json.Marshal(tree)
+	}
+}
@@ -1,23 +1,129 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
+	"hash"
 	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"gopkg.in/Shopify/sarama.v1"
+	"github.com/Shopify/sarama"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/xdg/scram"
 )
 
 type kafkaConfig struct {
-	BrokerList []string
-	CertFile   string
-	KeyFile    string
-	CaFile     string
-	VerifySsl  bool
+	BrokerList    []string
+	TLS           bool
+	CertFile      string
+	KeyFile       string
+	CaFile        string
+	VerifySsl     bool
+	TLSServerName string
+	TLSMinVersion string
+
+	SASLMechanism    string
+	SASLUsername     string
+	SASLPassword     string
+	SASLPasswordFile string
+
+	Async          bool
+	FlushMessages  int
+	FlushBytes     int
+	FlushFrequency time.Duration
+	Compression    string
+	RequiredAcks   string
+	MaxInFlight    int
+
+	// MetricRegistry receives the metrics of the producer, sarama creates a registry when it is nil
+	MetricRegistry gometrics.Registry
+}
+
+// kafkaSender sends messages to kafka, hiding whether this happens synchronously or asynchronously.
+type kafkaSender interface {
+	send(msg *sarama.ProducerMessage) error
+	// Close waits for all messages to be sent. It is safe to call it more than once.
+	Close() error
+}
+
+// syncSender sends one message at a time and waits for it to be acknowledged.
+type syncSender struct {
+	producer sarama.SyncProducer
+	once     sync.Once
+}
+
+func (s *syncSender) send(msg *sarama.ProducerMessage) error {
+	_, _, err := s.producer.SendMessage(msg)
+	return err
+}
+
+func (s *syncSender) Close() error {
+	var err error
+	s.once.Do(func() { err = s.producer.Close() })
+	return err
+}
+
+// asyncSender hands messages to an asynchronous producer, which sends them in batches.
+// Sending never fails, instead the acknowledgements and errors are counted while they are drained.
+type asyncSender struct {
+	producer  sarama.AsyncProducer
+	successes int64
+	errors    int64
+	lastError atomic.Value
+	drained   sync.WaitGroup
+	once      sync.Once
+}
+
+func newAsyncSender(producer sarama.AsyncProducer) *asyncSender {
+	s := &asyncSender{producer: producer}
+	s.drained.Add(2)
+	go func() {
+		defer s.drained.Done()
+		for range producer.Successes() {
+			atomic.AddInt64(&s.successes, 1)
+		}
+	}()
+	go func() {
+		defer s.drained.Done()
+		for err := range producer.Errors() {
+			atomic.AddInt64(&s.errors, 1)
+			s.lastError.Store(err.Err)
+		}
+	}()
+	return s
+}
+
+func (s *asyncSender) failed() int64 {
+	return atomic.LoadInt64(&s.errors)
+}
+
+func (s *asyncSender) send(msg *sarama.ProducerMessage) error {
+	s.producer.Input() <- msg
+	return nil
+}
+
+func (s *asyncSender) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.producer.AsyncClose()
+		s.drained.Wait()
+		fmt.Fprintf(os.Stderr, "[INFO] Kafka acknowledged %d messages, %d failed\n", atomic.LoadInt64(&s.successes), atomic.LoadInt64(&s.errors))
+		if lastError, ok := s.lastError.Load().(error); ok {
+			err = fmt.Errorf("Failed to send %d messages to kafka, last error: %s", atomic.LoadInt64(&s.errors), lastError)
+		}
+	})
+	return err
 }
 
-func createKafkaProducer(kafkaConfig kafkaConfig) (sarama.SyncProducer, error) {
+func createKafkaProducer(kafkaConfig kafkaConfig) (kafkaSender, error) {
 	if len(kafkaConfig.BrokerList) == 0 {
 		return nil, errors.New("A list of initial brokers must be given when using the kafka output")
 	}
@@ -27,7 +133,8 @@ func createKafkaProducer(kafkaConfig kafkaConfig) (sarama.SyncProducer, error) {
 	config.Producer.RequiredAcks = sarama.WaitForAll
 	config.Producer.Retry.Max = 10
 	config.Producer.Return.Successes = true
-	tlsConfig, err := createTLSConfiguration(kafkaConfig.CertFile, kafkaConfig.KeyFile, kafkaConfig.CaFile, kafkaConfig.VerifySsl)
+	config.Producer.Return.Errors = true
+	tlsConfig, err := createTLSConfiguration(kafkaConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -36,31 +143,202 @@ func createKafkaProducer(kafkaConfig kafkaConfig) (sarama.SyncProducer, error) {
 		config.Net.TLS.Enable = true
 	}
 
-	return sarama.NewSyncProducer(kafkaConfig.BrokerList, config)
-}
+	err = configureSASL(config, kafkaConfig)
+	if err != nil {
+		return nil, err
+	}
 
-func createTLSConfiguration(certFile string, keyFile string, caFile string, verifySsl bool) (*tls.Config, error) {
-	var t *tls.Config
-	if certFile != "" && keyFile != "" && caFile != "" {
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if kafkaConfig.RequiredAcks != "" {
+		config.Producer.RequiredAcks, err = parseRequiredAcks(kafkaConfig.RequiredAcks)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if kafkaConfig.Compression != "" {
+		config.Producer.Compression, err = parseCompression(kafkaConfig.Compression)
 		if err != nil {
 			return nil, err
 		}
+	}
+	if kafkaConfig.MaxInFlight > 0 {
+		config.Net.MaxOpenRequests = kafkaConfig.MaxInFlight
+	}
+	if kafkaConfig.MetricRegistry != nil {
+		config.MetricRegistry = kafkaConfig.MetricRegistry
+	}
 
-		caCert, err := ioutil.ReadFile(caFile)
+	if !kafkaConfig.Async {
+		producer, err := sarama.NewSyncProducer(kafkaConfig.BrokerList, config)
 		if err != nil {
 			return nil, err
 		}
+		return &syncSender{producer: producer}, nil
+	}
 
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
+	config.Producer.Flush.Messages = kafkaConfig.FlushMessages
+	config.Producer.Flush.Bytes = kafkaConfig.FlushBytes
+	config.Producer.Flush.Frequency = kafkaConfig.FlushFrequency
+	producer, err := sarama.NewAsyncProducer(kafkaConfig.BrokerList, config)
+	if err != nil {
+		return nil, err
+	}
+	return newAsyncSender(producer), nil
+}
 
-		t = &tls.Config{
-			Certificates:       []tls.Certificate{cert},
-			RootCAs:            caCertPool,
-			InsecureSkipVerify: verifySsl,
+// scramClient implements the SCRAM exchange for sarama, with the given hash function.
+type scramClient struct {
+	hash         scram.HashGeneratorFcn
+	conversation *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.hash.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
+
+// scramHashes maps the SCRAM mechanisms onto their hash function.
+var scramHashes = map[string]scram.HashGeneratorFcn{
+	sarama.SASLTypeSCRAMSHA256: func() hash.Hash { return sha256.New() },
+	sarama.SASLTypeSCRAMSHA512: func() hash.Hash { return sha512.New() },
+}
+
+// configureSASL enables SASL authentication on config when a mechanism is given.
+// The password is read from SASLPasswordFile when no SASLPassword is given.
+func configureSASL(config *sarama.Config, kafkaConfig kafkaConfig) error {
+	switch kafkaConfig.SASLMechanism {
+	case "":
+		return nil
+	case "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512":
+	default:
+		return fmt.Errorf("kafka-sasl-mechanism should be oneOf ['PLAIN', 'SCRAM-SHA-256', 'SCRAM-SHA-512']. Received %s", kafkaConfig.SASLMechanism)
+	}
+
+	password := kafkaConfig.SASLPassword
+	if password == "" && kafkaConfig.SASLPasswordFile != "" {
+		b, err := ioutil.ReadFile(kafkaConfig.SASLPasswordFile)
+		if err != nil {
+			return err
 		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+	if kafkaConfig.SASLUsername == "" || password == "" {
+		return errors.New("A username and password must be given when using SASL authentication")
+	}
+
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.User = kafkaConfig.SASLUsername
+	config.Net.SASL.Password = password
+	config.Net.SASL.Mechanism = sarama.SASLMechanism(kafkaConfig.SASLMechanism)
+	if hash, ok := scramHashes[kafkaConfig.SASLMechanism]; ok {
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: hash}
+		}
+	}
+	return nil
+}
+
+// parseRequiredAcks converts the name of an acknowledgement level into its sarama equivalent.
+func parseRequiredAcks(acks string) (sarama.RequiredAcks, error) {
+	switch acks {
+	case "none":
+		return sarama.NoResponse, nil
+	case "local":
+		return sarama.WaitForLocal, nil
+	case "all":
+		return sarama.WaitForAll, nil
+	default:
+		return 0, fmt.Errorf("kafka-required-acks should be oneOf ['none', 'local', 'all']. Received %s", acks)
+	}
+}
+
+// parseCompression converts the name of a compression codec into its sarama equivalent.
+func parseCompression(codec string) (sarama.CompressionCodec, error) {
+	switch codec {
+	case "none":
+		return sarama.CompressionNone, nil
+	case "gzip":
+		return sarama.CompressionGZIP, nil
+	case "snappy":
+		return sarama.CompressionSnappy, nil
+	case "lz4":
+		return sarama.CompressionLZ4, nil
+	default:
+		return 0, fmt.Errorf("kafka-compression should be oneOf ['none', 'gzip', 'snappy', 'lz4']. Received %s", codec)
+	}
+}
+
+// createTLSConfiguration returns the TLS configuration for the connection to kafka, or nil if TLS is not used.
+// TLS is used when it is enabled explicitly or when any of the certificate files is given.
+// The server certificate is verified against the CA file, or the system roots when there is none,
+// unless VerifySsl is false. The client certificate is only presented when both a cert and a key file are given.
+func createTLSConfiguration(kafkaConfig kafkaConfig) (*tls.Config, error) {
+	if !kafkaConfig.TLS && kafkaConfig.CertFile == "" && kafkaConfig.KeyFile == "" && kafkaConfig.CaFile == "" {
+		return nil, nil
 	}
-	// will be nil by default if nothing is provided
+
+	minVersion, err := parseTLSVersion(kafkaConfig.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	t := &tls.Config{
+		ServerName:         kafkaConfig.TLSServerName,
+		MinVersion:         minVersion,
+		InsecureSkipVerify: !kafkaConfig.VerifySsl,
+	}
+
+	if (kafkaConfig.CertFile == "") != (kafkaConfig.KeyFile == "") {
+		return nil, errors.New("A certificate file and a key file must be given together for client authentication to kafka")
+	}
+	if kafkaConfig.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(kafkaConfig.CertFile, kafkaConfig.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+
+	// Leaving RootCAs empty makes crypto/tls use the system roots
+	if kafkaConfig.CaFile != "" {
+		caCert, err := ioutil.ReadFile(kafkaConfig.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("No certificates could be parsed from the ca file %s", kafkaConfig.CaFile)
+		}
+		t.RootCAs = caCertPool
+	}
+
 	return t, nil
 }
+
+// parseTLSVersion converts a TLS version number (eg: 1.2) into its crypto/tls equivalent.
+// An empty version defaults to TLS 1.2.
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("kafka-tls-min-version should be oneOf ['1.0', '1.1', '1.2', '1.3']. Received %s", version)
+	}
+}
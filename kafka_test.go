@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+)
+
+func TestConfigureSASL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-sasl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("from-file\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		config   kafkaConfig
+		enabled  bool
+		password string
+		scram    bool
+		fails    bool
+	}{
+		{name: "disabled", config: kafkaConfig{}},
+		{name: "plain", config: kafkaConfig{SASLMechanism: "PLAIN", SASLUsername: "user", SASLPassword: "secret"}, enabled: true, password: "secret"},
+		{name: "scram-sha-256", config: kafkaConfig{SASLMechanism: "SCRAM-SHA-256", SASLUsername: "user", SASLPassword: "secret"}, enabled: true, password: "secret", scram: true},
+		{name: "scram-sha-512", config: kafkaConfig{SASLMechanism: "SCRAM-SHA-512", SASLUsername: "user", SASLPassword: "secret"}, enabled: true, password: "secret", scram: true},
+		{name: "password file is trimmed", config: kafkaConfig{SASLMechanism: "PLAIN", SASLUsername: "user", SASLPasswordFile: passwordFile}, enabled: true, password: "from-file"},
+		{name: "password takes precedence over file", config: kafkaConfig{SASLMechanism: "PLAIN", SASLUsername: "user", SASLPassword: "secret", SASLPasswordFile: passwordFile}, enabled: true, password: "secret"},
+		{name: "missing password file", config: kafkaConfig{SASLMechanism: "PLAIN", SASLUsername: "user", SASLPasswordFile: filepath.Join(dir, "missing")}, fails: true},
+		{name: "missing username", config: kafkaConfig{SASLMechanism: "PLAIN", SASLPassword: "secret"}, fails: true},
+		{name: "missing password", config: kafkaConfig{SASLMechanism: "SCRAM-SHA-256", SASLUsername: "user"}, fails: true},
+		{name: "unknown mechanism", config: kafkaConfig{SASLMechanism: "GSSAPI", SASLUsername: "user", SASLPassword: "secret"}, fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := sarama.NewConfig()
+			err := configureSASL(config, test.config)
+			if test.fails {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Net.SASL.Enable != test.enabled {
+				t.Fatalf("expected SASL enabled to be %t", test.enabled)
+			}
+			if !test.enabled {
+				return
+			}
+			if config.Net.SASL.Password != test.password {
+				t.Errorf("expected password %q, got %q", test.password, config.Net.SASL.Password)
+			}
+			if string(config.Net.SASL.Mechanism) != test.config.SASLMechanism {
+				t.Errorf("expected mechanism %s, got %s", test.config.SASLMechanism, config.Net.SASL.Mechanism)
+			}
+			if (config.Net.SASL.SCRAMClientGeneratorFunc != nil) != test.scram {
+				t.Errorf("expected a SCRAM client to be set: %t", test.scram)
+			}
+			if err := config.Validate(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSCRAMClient(t *testing.T) {
+	for mechanism, hash := range scramHashes {
+		t.Run(mechanism, func(t *testing.T) {
+			credentials, err := hash.NewClient("user", "secret", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored := credentials.GetStoredCredentials(scram.KeyFactors{Salt: "salt", Iters: 4096})
+			server, err := hash.NewServer(func(user string) (scram.StoredCredentials, error) {
+				return stored, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config := sarama.NewConfig()
+			if err := configureSASL(config, kafkaConfig{SASLMechanism: mechanism, SASLUsername: "user", SASLPassword: "secret"}); err != nil {
+				t.Fatal(err)
+			}
+			client := config.Net.SASL.SCRAMClientGeneratorFunc()
+			if err := client.Begin(config.Net.SASL.User, config.Net.SASL.Password, ""); err != nil {
+				t.Fatal(err)
+			}
+			conversation := server.NewConversation()
+			challenge := ""
+			for !client.Done() {
+				response, err := client.Step(challenge)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if client.Done() {
+					break
+				}
+				challenge, err = conversation.Step(response)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !conversation.Valid() {
+				t.Error("expected the server to accept the client")
+			}
+		})
+	}
+}
+
+// testCertificate is a certificate with its key, which is written to PEM files for createTLSConfiguration.
+type testCertificate struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCertificate creates a certificate for the template, signed by parent (or self-signed when parent is nil).
+func newTestCertificate(t *testing.T, dir string, name string, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCertificate{cert: cert, key: key, certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key")}
+	if err := ioutil.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newTestCA(t *testing.T, dir string, name string) *testCertificate {
+	return newTestCertificate(t, dir, name, &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}, nil)
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// handshake runs a TLS handshake between a server with config server and a client with the
+// configuration created for kafkaConfig. It returns the error of the client, or else of the server.
+func handshake(t *testing.T, server *tls.Config, kafkaConfig kafkaConfig) error {
+	client, err := createTLSConfiguration(kafkaConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		serverErr <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", listener.Addr().String(), client)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return <-serverErr
+}
+
+func TestCreateTLSConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir, "ca")
+	otherCA := newTestCA(t, dir, "other-ca")
+	serverUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	localhost := newTestCertificate(t, dir, "localhost", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: serverUsage}, ca)
+	named := newTestCertificate(t, dir, "kafka.test", &x509.Certificate{DNSNames: []string{"kafka.test"}, ExtKeyUsage: serverUsage}, ca)
+	untrusted := newTestCertificate(t, dir, "untrusted", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: serverUsage}, otherCA)
+	client := newTestCertificate(t, dir, "client", &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	requireClientCert := &tls.Config{
+		Certificates: []tls.Certificate{localhost.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+
+	tests := []struct {
+		name   string
+		server *tls.Config
+		config kafkaConfig
+		fails  bool
+	}{
+		{
+			name:   "ca only",
+			server: &tls.Config{Certificates: []tls.Certificate{localhost.tlsCertificate()}},
+			config: kafkaConfig{CaFile: ca.certFile, VerifySsl: true},
+		},
+		{
+			name:   "untrusted certificate",
+			server: &tls.Config{Certificates: []tls.Certificate{untrusted.tlsCertificate()}},
+			config: kafkaConfig{CaFile: ca.certFile, VerifySsl: true},
+			fails:  true,
+		},
+		{
+			name:   "untrusted certificate without verification",
+			server: &tls.Config{Certificates: []tls.Certificate{untrusted.tlsCertificate()}},
+			config: kafkaConfig{TLS: true, VerifySsl: false},
+		},
+		{
+			name:   "client certificate",
+			server: requireClientCert,
+			config: kafkaConfig{CaFile: ca.certFile, CertFile: client.certFile, KeyFile: client.keyFile, VerifySsl: true},
+		},
+		{
+			name:   "missing client certificate",
+			server: requireClientCert,
+			config: kafkaConfig{CaFile: ca.certFile, VerifySsl: true},
+			fails:  true,
+		},
+		{
+			name:   "server name mismatch",
+			server: &tls.Config{Certificates: []tls.Certificate{named.tlsCertificate()}},
+			config: kafkaConfig{CaFile: ca.certFile, VerifySsl: true},
+			fails:  true,
+		},
+		{
+			name:   "server name override",
+			server: &tls.Config{Certificates: []tls.Certificate{named.tlsCertificate()}},
+			config: kafkaConfig{CaFile: ca.certFile, VerifySsl: true, TLSServerName: "kafka.test"},
+		},
+		{
+			name:   "min version accepted",
+			server: &tls.Config{Certificates: []tls.Certificate{localhost.tlsCertificate()}, MaxVersion: tls.VersionTLS12},
+			config: kafkaConfig{CaFile: ca.certFile, VerifySsl: true, TLSMinVersion: "1.2"},
+		},
+		{
+			name:   "min version rejected",
+			server: &tls.Config{Certificates: []tls.Certificate{localhost.tlsCertificate()}, MaxVersion: tls.VersionTLS12},
+			config: kafkaConfig{CaFile: ca.certFile, VerifySsl: true, TLSMinVersion: "1.3"},
+			fails:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := handshake(t, test.server, test.config)
+			if test.fails && err == nil {
+				t.Fatal("expected the handshake to fail")
+			}
+			if !test.fails && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := ioutil.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := []struct {
+		name   string
+		config kafkaConfig
+	}{
+		{name: "cert without key", config: kafkaConfig{CertFile: client.certFile}},
+		{name: "key without cert", config: kafkaConfig{KeyFile: client.keyFile}},
+		{name: "unparsable ca", config: kafkaConfig{CaFile: garbage}},
+		{name: "missing ca", config: kafkaConfig{CaFile: filepath.Join(dir, "missing.pem")}},
+		{name: "unknown min version", config: kafkaConfig{TLS: true, TLSMinVersion: "2.0"}},
+	}
+	for _, test := range invalid {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := createTLSConfiguration(test.config); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+
+	config, err := createTLSConfiguration(kafkaConfig{})
+	if config != nil || err != nil {
+		t.Errorf("expected TLS to be disabled, got %v, %v", config, err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "time"
+
+// nextConsent creates the next consent event, following the lifecycle of the
+// consents of each user when that is enabled.
+func (g *generator) nextConsent() message {
+	if g.lifecycle {
+		return g.makeConsentUpdate()
+	}
+	return g.makeConsent()
+}
+
+// makeConsentUpdate creates the next version of the consent of a random user.
+// Users without a consent (or with a withdrawn one) grant a new consent.
+// Others withdraw their consent with a probability of withdrawalRate, and
+// otherwise add or remove a single simple policy.
+// Every version gets a new ConsentID, but is keyed on the UserID, so that the
+// latest version of a consent is retained on a log compacted topic.
+func (g *generator) makeConsentUpdate() message {
+	if g.consents == nil {
+		g.consents = make(map[string]policy, len(g.config.UserID))
+	}
+	userID := getRandomValue(g.rand, g.config.UserID)
+	previous, ok := g.consents[userID]
+
+	var consent policy
+	switch {
+	case !ok || len(previous.SimplePolicies) == 0:
+		consent = g.makePolicy(userID, g.rand.Intn(g.maxSize)+1)
+	case g.rand.Float64() < g.withdrawalRate:
+		consent = g.makePolicy(userID, 0)
+	case len(previous.SimplePolicies) < g.maxSize && (len(previous.SimplePolicies) == 1 || g.rand.Intn(2) == 0):
+		consent = g.makePolicy(userID, 1)
+		consent.SimplePolicies = append(append([]simplepolicy{}, previous.SimplePolicies...), consent.SimplePolicies...)
+	default:
+		consent = g.makePolicy(userID, 0)
+		removed := g.rand.Intn(len(previous.SimplePolicies))
+		consent.SimplePolicies = append(append([]simplepolicy{}, previous.SimplePolicies[:removed]...), previous.SimplePolicies[removed+1:]...)
+	}
+	if g.consentTTL > 0 && len(consent.SimplePolicies) > 0 {
+		consent.Expires = consent.Timestamp + int64(g.consentTTL/time.Millisecond)
+	}
+	g.consents[userID] = consent
+
+	return message{
+		Key:   consent.UserID,
+		Value: consent,
+	}
+}
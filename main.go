@@ -17,6 +17,7 @@ package main
  */
 
 import (
+	"math/rand"
 	"os"
 
 	"github.com/urfave/cli"
@@ -24,31 +25,34 @@ import (
 
 // Schema of a SPECIAL log message.
 type log struct {
-	Timestamp  int64    `json:"timestamp"`
-	Process    string   `json:"process"`
-	Purpose    string   `json:"purpose"`
-	Processing string   `json:"processing"`
-	Recipient  string   `json:"recipient"`
-	Storage    string   `json:"storage"`
-	UserID     string   `json:"userID"`
-	Data       []string `json:"data"`
+	Timestamp  int64    `json:"timestamp" rdf:"entry,splog:transactionTime,dateTime"`
+	Process    string   `json:"process" rdf:"log,prov:wasAttributedTo,applications"`
+	Purpose    string   `json:"purpose" rdf:"content,spl:hasPurpose,iri"`
+	Processing string   `json:"processing" rdf:"content,spl:hasProcessing,iri"`
+	Recipient  string   `json:"recipient" rdf:"content,spl:hasRecipient,iri"`
+	Storage    string   `json:"storage" rdf:"content,spl:hasStorage,iri"`
+	UserID     string   `json:"userID" rdf:"entry,splog:dataSubject,users"`
+	Data       []string `json:"data" rdf:"content,spl:hasData,iri"`
 	EventID    string   `json:"eventID"`
 }
 
 // Schema of a SPECIAL simplepolicy event
 type simplepolicy struct {
-	Purpose    string `json:"purposeCollection"`
-	Processing string `json:"processingCollection"`
-	Recipient  string `json:"recipientCollection"`
-	Storage    string `json:"storageCollection"`
-	Data       string `json:"dataCollection"`
+	Purpose    string `json:"purposeCollection" rdf:",spl:hasPurpose,iri"`
+	Processing string `json:"processingCollection" rdf:",spl:hasProcessing,iri"`
+	Recipient  string `json:"recipientCollection" rdf:",spl:hasRecipient,iri"`
+	Storage    string `json:"storageCollection" rdf:",spl:hasStorage,iri"`
+	Data       string `json:"dataCollection" rdf:",spl:hasData,iri"`
 }
 
+// Schema of a SPECIAL consent event
+// A consent without simple policies withdraws any earlier consent of the user.
 type policy struct {
 	ConsentID      string         `json:"-"`
-	Timestamp      int64          `json:"timestamp"`
-	UserID         string         `json:"userID"`
-	SimplePolicies []simplepolicy `json:"simplePolicies"`
+	Timestamp      int64          `json:"timestamp" rdf:"consent,dct:created,dateTime"`
+	UserID         string         `json:"userID" rdf:"consent,spl:hasDataSubject,users"`
+	SimplePolicies []simplepolicy `json:"simplePolicies" rdf:"consent,svp:simplePolicy"`
+	Expires        int64          `json:"expires,omitempty" rdf:"consent,dct:valid,dateTime"`
 }
 
 // Schema of the configuration file of this application.
@@ -63,9 +67,11 @@ type config struct {
 	Storage    []string `json:"storage,omitempty"`
 	UserID     []string `json:"userID,omitempty"`
 	Data       []string `json:"data,omitempty"`
+	Traffic    *traffic `json:"traffic,omitempty"`
+	IRIs       *iris    `json:"iris,omitempty"`
 }
 
-func makeDefaultConfig() config {
+func makeDefaultConfig(r *rand.Rand) config {
 	// Some hardcoded default values to make life easier for the user.
 	defaultProcess := []string{"mailinglist", "send-invoice"}
 	defaultPurpose := []string{"spl:AnyPurpose", "svpu:Account", "svpu:Admin", "svpu:AnyContact", "svpu:Arts", "svpu:AuxPurpose", "svpu:Browsing", "svpu:Charity", "svpu:Communicate", "svpu:Current", "svpu:Custom", "svpu:Delivery", "svpu:Develop", "svpu:Downloads", "svpu:Education", "svpu:Feedback", "svpu:Finmgt", "svpu:Gambling", "svpu:Gaming", "svpu:Government", "svpu:Health", "svpu:Historical", "svpu:Login", "svpu:Marketing", "svpu:News", "svpu:OtherContact", "svpu:Payment", "svpu:Sales", "svpu:Search", "svpu:State", "svpu:Tailoring", "svpu:Telemarketing"}
@@ -95,14 +101,12 @@ func makeDefaultConfig() config {
 		Processing: defaultProcessing,
 		Storage:    defaultStorage,
 		Recipient:  defaultRecipient,
-		UserID:     makeUUIDList(5),
+		UserID:     makeUUIDList(r, 5),
 		Data:       defaultData,
 	}
 
 }
 
-var defaultConfig = makeDefaultConfig()
-
 func main() {
 	app := cli.NewApp()
 	app.Name = "Special Log Generator"
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// metricsPrefix is the prefix of all metrics exported by the generator.
+const metricsPrefix = "special_log_generator_"
+
+// latencyBuckets are the upper bounds (in seconds) of the buckets of the send latency histogram.
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// saramaQuantiles are the quantiles exported for the histograms of the kafka producer.
+var saramaQuantiles = []float64{0.5, 0.75, 0.95, 0.99}
+
+// histogram counts observations in cumulative buckets, like a prometheus histogram.
+type histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// observe records a single observation.
+func (h *histogram) observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write writes the histogram in the prometheus text format.
+func (h *histogram) write(w io.Writer, name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// failureCounter is implemented by senders which deliver in the background, and
+// count the events they failed to deliver instead of returning an error straight away.
+type failureCounter interface {
+	failed() int64
+}
+
+// metricsHandler serves the metrics of a run in the prometheus text format.
+// The metrics of the kafka producers are exported too when registry is set.
+type metricsHandler struct {
+	stats    *meter
+	failures []failureCounter
+	registry gometrics.Registry
+}
+
+// serveMetrics serves the metrics on addr (eg: :9100) in the background, at /metrics.
+// Listening happens straight away, so an address which is in use is reported immediately.
+func serveMetrics(addr string, handler *metricsHandler) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go server.Serve(listener)
+	return server, nil
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := h.stats
+
+	writeHeader(w, metricsPrefix+"events_total", "counter", "The number of events written to the outputs, by type.")
+	for _, eventType := range m.types() {
+		fmt.Fprintf(w, "%sevents_total{type=%q} %d\n", metricsPrefix, eventType, m.typeCount(eventType))
+	}
+
+	writeHeader(w, metricsPrefix+"bytes_written_total", "counter", "The number of serialized bytes written to the outputs.")
+	fmt.Fprintf(w, "%sbytes_written_total %d\n", metricsPrefix, m.written())
+
+	errors := m.failed()
+	for _, f := range h.failures {
+		errors += f.failed()
+	}
+	writeHeader(w, metricsPrefix+"send_errors_total", "counter", "The number of events or requests which could not be delivered.")
+	fmt.Fprintf(w, "%ssend_errors_total %d\n", metricsPrefix, errors)
+
+	writeHeader(w, metricsPrefix+"send_duration_seconds", "histogram", "The time it takes to write an event to all outputs.")
+	m.latency.write(w, metricsPrefix+"send_duration_seconds")
+
+	writeHeader(w, metricsPrefix+"target_rate_events_per_second", "gauge", "The targeted number of events per second, 0 when unlimited.")
+	fmt.Fprintf(w, "%starget_rate_events_per_second %g\n", metricsPrefix, m.target)
+
+	_, rate := m.rate()
+	writeHeader(w, metricsPrefix+"achieved_rate_events_per_second", "gauge", "The average number of events per second since the start.")
+	fmt.Fprintf(w, "%sachieved_rate_events_per_second %g\n", metricsPrefix, rate)
+
+	if h.registry != nil {
+		writeSaramaMetrics(w, h.registry)
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric.
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var invalidMetricCharacters = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// writeSaramaMetrics writes the go-metrics of the kafka producers in the prometheus text format.
+// Meters become counters (with their one minute rate as a gauge) and histograms become summaries.
+func writeSaramaMetrics(w io.Writer, registry gometrics.Registry) {
+	metrics := map[string]interface{}{}
+	names := []string{}
+	registry.Each(func(name string, metric interface{}) {
+		name = metricsPrefix + "kafka_" + invalidMetricCharacters.ReplaceAllString(name, "_")
+		metrics[name] = metric
+		names = append(names, name)
+	})
+	sort.Strings(names)
+
+	for _, name := range names {
+		switch metric := metrics[name].(type) {
+		case gometrics.Meter:
+			snapshot := metric.Snapshot()
+			writeHeader(w, name+"_total", "counter", "Kafka producer metric.")
+			fmt.Fprintf(w, "%s_total %d\n", name, snapshot.Count())
+			writeHeader(w, name+"_rate1", "gauge", "Kafka producer metric, one minute rate.")
+			fmt.Fprintf(w, "%s_rate1 %g\n", name, snapshot.Rate1())
+		case gometrics.Histogram:
+			snapshot := metric.Snapshot()
+			writeHeader(w, name, "summary", "Kafka producer metric.")
+			for i, value := range snapshot.Percentiles(saramaQuantiles) {
+				fmt.Fprintf(w, "%s{quantile=\"%g\"} %g\n", name, saramaQuantiles[i], value)
+			}
+			fmt.Fprintf(w, "%s_sum %d\n", name, snapshot.Sum())
+			fmt.Fprintf(w, "%s_count %d\n", name, snapshot.Count())
+		case gometrics.Counter:
+			writeHeader(w, name, "counter", "Kafka producer metric.")
+			fmt.Fprintf(w, "%s %d\n", name, metric.Count())
+		case gometrics.Gauge:
+			writeHeader(w, name, "gauge", "Kafka producer metric.")
+			fmt.Fprintf(w, "%s %d\n", name, metric.Value())
+		case gometrics.GaugeFloat64:
+			writeHeader(w, name, "gauge", "Kafka producer metric.")
+			fmt.Fprintf(w, "%s %g\n", name, metric.Value())
+		}
+	}
+}
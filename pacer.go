@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxBacklog is how far a pacer can fall behind its schedule before it gives up on catching up.
+// This prevents a long stall (eg: a slow broker) from being followed by an equally long burst.
+const maxBacklog = time.Second
+
+// pacer schedules events on an absolute timeline according to an arrival model.
+// Unlike sleeping between events, the time spent generating and sending an
+// event does not lower the rate, because it is deducted from the next wait.
+type pacer struct {
+	arrivals arrivals
+	due      time.Time
+}
+
+// wait blocks until the next event is due and schedules the event after it.
+// It returns the error of ctx when ctx is cancelled before the event is due.
+func (p *pacer) wait(ctx context.Context) error {
+	now := time.Now()
+	if p.due.IsZero() || now.Sub(p.due) > maxBacklog {
+		p.due = now
+	}
+	if d := p.due.Sub(now); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	} else if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	p.due = p.due.Add(p.arrivals.next(p.due))
+	return nil
+}
+
+// meter counts the events and bytes written to the outputs, to compare the achieved rate with the target.
+// It also keeps the counts per event type and the latency of writes, which are exported as metrics.
+type meter struct {
+	count  int64
+	bytes  int64
+	errors int64
+	start  time.Time
+	target float64
+
+	mutex      sync.Mutex
+	typeCounts map[string]int64
+	latency    *histogram
+}
+
+func newMeter(target float64) *meter {
+	return &meter{start: time.Now(), target: target, typeCounts: map[string]int64{}, latency: newHistogram(latencyBuckets)}
+}
+
+// mark records that an event of the given type and number of bytes was written, which took latency.
+func (m *meter) mark(eventType string, bytes int, latency time.Duration) {
+	atomic.AddInt64(&m.count, 1)
+	atomic.AddInt64(&m.bytes, int64(bytes))
+	m.mutex.Lock()
+	m.typeCounts[eventType]++
+	m.mutex.Unlock()
+	m.latency.observe(latency.Seconds())
+}
+
+// fail records that writing to or closing an output failed.
+func (m *meter) fail() {
+	atomic.AddInt64(&m.errors, 1)
+}
+
+// types returns the sorted event types which were written.
+func (m *meter) types() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	types := make([]string, 0, len(m.typeCounts))
+	for eventType := range m.typeCounts {
+		types = append(types, eventType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// typeCount returns the number of events of eventType which were written.
+func (m *meter) typeCount(eventType string) int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.typeCounts[eventType]
+}
+
+// written returns the number of bytes written.
+func (m *meter) written() int64 {
+	return atomic.LoadInt64(&m.bytes)
+}
+
+// failed returns the number of failed writes.
+func (m *meter) failed() int64 {
+	return atomic.LoadInt64(&m.errors)
+}
+
+// rate returns the number of events written and the achieved number of events per second since the meter started.
+func (m *meter) rate() (int64, float64) {
+	count := atomic.LoadInt64(&m.count)
+	return count, float64(count) / time.Since(m.start).Seconds()
+}
+
+// targetRate describes the target rate of the meter.
+func (m *meter) targetRate() string {
+	if m.target > 0 {
+		return fmt.Sprintf("%.1f events/s", m.target)
+	}
+	return "unlimited"
+}
+
+// report writes the achieved and target rate to w.
+func (m *meter) report(w io.Writer) {
+	count, rate := m.rate()
+	fmt.Fprintf(w, "[INFO] Wrote %d events in %s, achieved %.1f events/s (target: %s)\n", count, time.Since(m.start).Round(time.Millisecond), rate, m.targetRate())
+}
+
+// summary writes the totals of the run to w.
+func (m *meter) summary(w io.Writer) {
+	count, rate := m.rate()
+	fmt.Fprintf(w, "[INFO] Wrote %d events (%d bytes) in %s, achieved %.1f events/s (target: %s), %d errors\n",
+		count, m.written(), time.Since(m.start).Round(time.Millisecond), rate, m.targetRate(), m.failed())
+}
+
+// reportEvery calls report every interval until stop is closed.
+// The function is meant to run as a go-routine.
+func (m *meter) reportEvery(interval time.Duration, w io.Writer, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.report(w)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -1,94 +1,560 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
-	"text/template"
 	"time"
 )
 
+// prefixes maps the prefixes used in the SPECIAL vocabularies onto their namespace.
+var prefixes = map[string]string{
+	"spl":   "http://www.specialprivacy.eu/langs/usage-policy#",
+	"svp":   "http://www.specialprivacy.eu/vocabs/policy#",
+	"svpu":  "http://www.specialprivacy.eu/vocabs/purposes#",
+	"svpr":  "http://www.specialprivacy.eu/vocabs/processing#",
+	"svr":   "http://www.specialprivacy.eu/vocabs/recipients#",
+	"svl":   "http://www.specialprivacy.eu/vocabs/locations#",
+	"svd":   "http://www.specialprivacy.eu/vocabs/data#",
+	"splog": "http://www.specialprivacy.eu/langs/splog#",
+	"dct":   "http://purl.org/dc/terms/",
+	"prov":  "http://www.w3.org/ns/prov#",
+	"skos":  "http://www.w3.org/2004/02/skos/core#",
+	"rdf":   "http://www.w3.org/1999/02/22-rdf-syntax-ns#",
+	"xsd":   "http://www.w3.org/2001/XMLSchema#",
+}
+
+// resourceNamespaces maps the prefixes of the generated resources (eg: users) onto their namespace.
+// They can be overridden by the iris section of the configuration file.
+var resourceNamespaces = map[string]string{
+	"logs":             "http://example.com/logs/",
+	"applications":     "http://example.com/applications/",
+	"logEntries":       "http://example.com/logEntries/",
+	"logEntryContents": "http://example.com/logEntryContents/",
+	"users":            "http://www.example.com/users/",
+	"policies":         "http://www.example.com/policy/",
+	"graphs":           "http://example.com/graphs/",
+}
+
+// Schema of the iris section of the configuration file: the base IRIs of the generated resources.
+type iris struct {
+	Logs             string `json:"logs,omitempty"`
+	LogEntries       string `json:"logEntries,omitempty"`
+	LogEntryContents string `json:"logEntryContents,omitempty"`
+	Users            string `json:"users,omitempty"`
+	Policies         string `json:"policies,omitempty"`
+	Applications     string `json:"applications,omitempty"`
+	Graphs           string `json:"graphs,omitempty"`
+}
+
+// setResourceNamespaces overrides the namespaces of the generated resources with the base IRIs which are set in i.
+// It must be called before any event is serialized.
+func setResourceNamespaces(i iris) error {
+	bases := map[string]string{
+		"logs":             i.Logs,
+		"logEntries":       i.LogEntries,
+		"logEntryContents": i.LogEntryContents,
+		"users":            i.Users,
+		"policies":         i.Policies,
+		"applications":     i.Applications,
+		"graphs":           i.Graphs,
+	}
+	for prefix, base := range bases {
+		if base == "" {
+			continue
+		}
+		u, err := url.Parse(base)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("iris.%s should be an absolute IRI (eg: http://example.com/%s/). Received %s", prefix, prefix, base)
+		}
+	}
+	for prefix, base := range bases {
+		if base != "" {
+			resourceNamespaces[prefix] = base
+		}
+	}
+	return nil
+}
+
+// graphName returns the named graph of v according to scheme (event, user or process), eg: graphs:user/{userID}.
+// It returns false when v has no value for the scheme (eg: the process of a consent), it then belongs to the default graph.
+func graphName(scheme string, v interface{}) (term, bool) {
+	id := ""
+	switch e := v.(type) {
+	case log:
+		id = map[string]string{"event": e.EventID, "user": e.UserID, "process": e.Process}[scheme]
+	case policy:
+		id = map[string]string{"event": e.ConsentID, "user": e.UserID}[scheme]
+	}
+	if id == "" {
+		return term{}, false
+	}
+	return iri(resourceNamespaces["graphs"] + scheme + "/" + url.PathEscape(id)), true
+}
+
 func expandPrefix(term string) string {
 	splits := strings.SplitN(term, ":", 2)
 	if len(splits) != 2 {
 		return term
 	}
-	prefix := splits[0]
-	attr := splits[1]
-	switch prefix {
-	case "spl":
-		return "http://www.specialprivacy.eu/langs/usage-policy#" + attr
-	case "svpu":
-		return "http://www.specialprivacy.eu/vocabs/purposes#" + attr
-	case "svpr":
-		return "http://www.specialprivacy.eu/vocabs/processing#" + attr
-	case "svr":
-		return "http://www.specialprivacy.eu/vocabs/recipients#" + attr
-	case "svl":
-		return "http://www.specialprivacy.eu/vocabs/locations#" + attr
-	case "svd":
-		return "http://www.specialprivacy.eu/vocabs/data#" + attr
-	case "splog":
-		return "http://www.specialprivacy.eu/langs/splog#" + attr
-	case "dct":
-		return "http://purl.org/dc/terms/" + attr
-	case "prov":
-		return "http://www.w3.org/ns/prov#" + attr
-	case "skos":
-		return "http://www.w3.org/2004/02/skos/core#" + attr
-	default:
+	namespace, ok := prefixes[splits[0]]
+	if !ok {
 		return term
 	}
+	return namespace + splits[1]
 }
 
-func getLogTTLTemplate() *template.Template {
-	funcMap := template.FuncMap{
-		"randomUUID": randomUUID,
-		"toISOTime": func(t int64) string {
-			output, _ := time.Unix(0, t*int64(time.Millisecond)).MarshalText()
-			return fmt.Sprintf("%s", output)
-		},
+// compactIRI is the inverse of expandPrefix, it returns iri unchanged when it is not in any of the known namespaces.
+func compactIRI(iri string) string {
+	if prefix, local, ok := splitIRI(iri, prefixes); ok {
+		return prefix + ":" + local
 	}
-	tmpl := "{{$contentId := randomUUID}}" +
-		"{{if .Process}}<http://example.com/logs/{{.Process}}><http://www.w3.org/1999/02/22-rdf-syntax-ns#type><http://www.specialprivacy.eu/langs/splog#Log>;" +
-		"<http://www.w3.org/ns/prov#wasAttributedTo><http://example.com/applications/{{.Process}}>;" +
-		"<http://www.specialprivacy.eu/langs/splog#logEntry><http://example.com/logEntries/{{.EventID}}>.{{end}}" +
-		"<http://example.com/logEntries/{{.EventID}}><http://www.w3.org/1999/02/22-rdf-syntax-ns#type><http://www.specialprivacy.eu/langs/splog#LogEntry>" +
-		"{{if .Timestamp}};<http://www.specialprivacy.eu/langs/splog#transactionTime>\"{{toISOTime .Timestamp}}\"^^<http://www.w3.org/2001/XMLSchema#dateTime>{{end}}" +
-		"{{if .UserID}};<http://www.specialprivacy.eu/langs/splog#dataSubject><http://www.example.com/users/{{.UserID}}>{{end}}" +
-		";<http://www.specialprivacy.eu/langs/splog#logEntryContent><http://example.com/logEntryContents/{{$contentId}}>." +
-		"<http://example.com/logEntryContents/{{$contentId}}><http://www.w3.org/1999/02/22-rdf-syntax-ns#type><http://www.specialprivacy.eu/langs/splog#LogEntryContent>" +
-		"{{if .Purpose}};<http://www.specialprivacy.eu/langs/usage-policy#hasPurpose><{{.Purpose}}>{{end}}" +
-		"{{if .Processing}};<http://www.specialprivacy.eu/langs/usage=policy#hasProcessing><{{.Processing}}>{{end}}" +
-		"{{if .Storage}};<http://www.specialprivacy.eu/langs/usage-policy#hasStorage><{{.Storage}}>{{end}}" +
-		"{{if .Recipient}};<http://www.specialprivacy.eu/langs/usage-policy#hasRecipient><{{.Recipient}}>{{end}}" +
-		"{{if .Data}}{{range .Data}};<http://www.specialprivacy.eu/langs/usage-policy#hasData><{{.}}>{{end}}{{end}}."
-	output, _ := template.New("ttl-template").Funcs(funcMap).Parse(tmpl)
-	return output
-}
-
-func getConsentTTLTemplate() *template.Template {
-	funcMap := template.FuncMap{
-		"randomUUID": randomUUID,
-		"toISOTime": func(t int64) string {
-			output, _ := time.Unix(0, t*int64(time.Millisecond)).MarshalText()
-			return fmt.Sprintf("%s", output)
+	return iri
+}
+
+// splitIRI splits iri in the prefix of its namespace and its local name.
+// The longest matching namespace wins (or the first prefix in alphabetical order when namespaces are equal),
+// so the result does not depend on the iteration order.
+func splitIRI(iri string, namespaces map[string]string) (string, string, bool) {
+	prefix, namespace := "", ""
+	for p, ns := range namespaces {
+		if !strings.HasPrefix(iri, ns) {
+			continue
+		}
+		if len(ns) > len(namespace) || (len(ns) == len(namespace) && p < prefix) {
+			prefix, namespace = p, ns
+		}
+	}
+	return prefix, strings.TrimPrefix(iri, namespace), namespace != ""
+}
+
+// toISOTime formats a timestamp in milliseconds as an xsd:dateTime in UTC.
+func toISOTime(t int64) string {
+	return time.Unix(0, t*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+}
+
+var (
+	rdfType     = expandPrefix("rdf:type")
+	xsdDateTime = expandPrefix("xsd:dateTime")
+	xsdInteger  = expandPrefix("xsd:integer")
+	xsdString   = expandPrefix("xsd:string")
+)
+
+type termKind int
+
+const (
+	iriTerm termKind = iota
+	blankTerm
+	literalTerm
+)
+
+// term is an RDF term: an IRI, a blank node or a literal with a datatype.
+type term struct {
+	kind     termKind
+	value    string
+	datatype string
+}
+
+// iri returns an IRI term, the characters which are not allowed in an IRI are percent-encoded,
+// so every format describes the same IRI.
+func iri(value string) term {
+	return term{kind: iriTerm, value: escapeIRI(value)}
+}
+
+func literal(value string, datatype string) term {
+	return term{kind: literalTerm, value: value, datatype: datatype}
+}
+
+// resource returns the IRI of a generated resource, named id in the namespace of prefix.
+func resource(prefix string, id string) term {
+	return iri(resourceNamespaces[prefix] + url.PathEscape(id))
+}
+
+type triple struct {
+	subject   term
+	predicate term
+	object    term
+}
+
+// graph holds the triples describing a single event, in the order in which they were added.
+type graph struct {
+	triples []triple
+	// sets holds the predicates which were added from a list
+	sets map[string]bool
+	// parts holds the nodes which are part of the node linking to them (eg: the content of a log entry)
+	parts  map[term]bool
+	blanks int
+}
+
+func newGraph() *graph {
+	return &graph{sets: map[string]bool{}, parts: map[term]bool{}}
+}
+
+func (g *graph) add(subject term, predicate term, object term) {
+	g.triples = append(g.triples, triple{subject, predicate, object})
+}
+
+// blank returns a new blank node, labelled uniquely within the graph.
+func (g *graph) blank() term {
+	g.blanks++
+	return term{kind: blankTerm, value: fmt.Sprintf("b%d", g.blanks)}
+}
+
+// rdfNode is one of the resources by which an event is described.
+// Fields are added to a node through their rdf tag, which is formatted as
+// "node,predicate[,kind]". The kind is empty for a plain literal, "iri" for
+// a term of a vocabulary (eg: svpu:Marketing), "dateTime" for a timestamp in
+// milliseconds, or the prefix of the namespace of a generated resource (eg: users).
+// Fields of a struct type become blank nodes, described by their own rdf tags.
+type rdfNode struct {
+	name  string
+	id    term
+	class string
+	links []rdfLink
+}
+
+// rdfLink links a node to another node of the same event.
+type rdfLink struct {
+	predicate string
+	node      string
+}
+
+// rdfDescribed is implemented by events which consist of several resources.
+// The first node is the event itself. Types which do not implement it are described by a single blank node.
+type rdfDescribed interface {
+	rdfNodes() []rdfNode
+}
+
+// rdfNodes describes a log as a log entry with its content, which is part of the log of its process.
+func (l log) rdfNodes() []rdfNode {
+	nodes := []rdfNode{
+		{
+			name:  "entry",
+			id:    resource("logEntries", l.EventID),
+			class: "splog:LogEntry",
+			links: []rdfLink{{"splog:logEntryContent", "content"}},
+		},
+		{
+			name:  "content",
+			id:    resource("logEntryContents", derivedUUID(fmt.Sprintf("logEntryContents/%s", l.EventID))),
+			class: "splog:LogEntryContent",
 		},
 	}
-	// TODO: either use #hasPolicy or #hasDataSubject to link policies to a data subject (keeping both until feedback from stakeholders is received)
-	tmpl :=
-		"<http://www.example.com/users/{{.UserID}}><http://www.specialprivacy.eu/langs/usage-policy#hasPolicy><http://www.example.com/policy/{{.ConsentID}}>." +
-			"<http://www.example.com/policy/{{.ConsentID}}><http://www.w3.org/1999/02/22-rdf-syntax-ns#type><http://www.specialprivacy.eu/vocabs/policy#Consent>" +
-			"{{if .Timestamp}};<http://purl.org/dc/terms/created>\"{{toISOTime .Timestamp}}\"^^<http://www.w3.org/2001/XMLSchema#dateTime>{{end}}" +
-			"{{if .UserID}};<http://www.specialprivacy.eu/langs/usage-policy#hasDataSubject><http://www.example.com/users/{{.UserID}}>{{end}}" +
-			"{{range .SimplePolicies}}" +
-			";<http://www.specialprivacy.eu/vocabs/policy#simplePolicy>[" +
-			"{{if .Purpose}}<http://www.specialprivacy.eu/langs/usage-policy#hasPurpose><{{.Purpose}}>{{end}}" +
-			"{{if .Processing}};<http://www.specialprivacy.eu/langs/usage=policy#hasProcessing><{{.Processing}}>{{end}}" +
-			"{{if .Storage}};<http://www.specialprivacy.eu/langs/usage-policy#hasStorage><{{.Storage}}>{{end}}" +
-			"{{if .Recipient}};<http://www.specialprivacy.eu/langs/usage-policy#hasRecipient><{{.Recipient}}>{{end}}" +
-			"{{if .Data}};<http://www.specialprivacy.eu/langs/usage-policy#hasData><{{.Data}}>{{end}}" +
-			"]" +
-			"{{end}}."
-	output, _ := template.New("ttl-template").Funcs(funcMap).Parse(tmpl)
-	return output
+	if l.Process != "" {
+		nodes = append(nodes, rdfNode{
+			name:  "log",
+			id:    resource("logs", l.Process),
+			class: "splog:Log",
+			links: []rdfLink{{"splog:logEntry", "entry"}},
+		})
+	}
+	return nodes
+}
+
+// rdfNodes describes a policy as a consent, which is a policy of its data subject.
+// TODO: either use #hasPolicy or #hasDataSubject to link policies to a data subject (keeping both until feedback from stakeholders is received)
+func (p policy) rdfNodes() []rdfNode {
+	nodes := []rdfNode{
+		{name: "consent", id: resource("policies", p.ConsentID), class: "svp:Consent"},
+	}
+	if p.UserID != "" {
+		nodes = append(nodes, rdfNode{
+			name:  "user",
+			id:    resource("users", p.UserID),
+			links: []rdfLink{{"spl:hasPolicy", "consent"}},
+		})
+	}
+	return nodes
+}
+
+// describe adds the triples describing v to the graph and returns the node of v itself.
+func (g *graph) describe(v interface{}) term {
+	var nodes []rdfNode
+	if d, ok := v.(rdfDescribed); ok {
+		nodes = d.rdfNodes()
+	} else {
+		nodes = []rdfNode{{id: g.blank()}}
+	}
+	ids := map[string]term{}
+	for _, node := range nodes {
+		ids[node.name] = node.id
+	}
+	for _, node := range nodes {
+		if node.class != "" {
+			g.add(node.id, iri(rdfType), iri(expandPrefix(node.class)))
+		}
+		g.describeFields(reflect.ValueOf(v), node.name, node.id)
+		for _, link := range node.links {
+			g.add(node.id, iri(expandPrefix(link.predicate)), ids[link.node])
+			g.parts[ids[link.node]] = true
+		}
+	}
+	return nodes[0].id
+}
+
+// describeFields adds the fields of the struct v, which are tagged for the node name, to subject.
+func (g *graph) describeFields(v reflect.Value, name string, subject term) {
+	for i := 0; i < v.NumField(); i++ {
+		tag := v.Type().Field(i).Tag.Get("rdf")
+		if tag == "" {
+			continue
+		}
+		parts := strings.SplitN(tag, ",", 3)
+		if parts[0] != name || len(parts) < 2 {
+			continue
+		}
+		kind := ""
+		if len(parts) == 3 {
+			kind = parts[2]
+		}
+		g.describeValue(subject, expandPrefix(parts[1]), kind, v.Field(i))
+	}
+}
+
+// describeValue adds a single field value, leaving out empty values.
+func (g *graph) describeValue(subject term, predicate string, kind string, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Slice:
+		g.sets[predicate] = true
+		for i := 0; i < v.Len(); i++ {
+			g.describeValue(subject, predicate, kind, v.Index(i))
+		}
+	case reflect.Struct:
+		object := g.blank()
+		g.add(subject, iri(predicate), object)
+		g.parts[object] = true
+		g.describeFields(v, "", object)
+	case reflect.Int64, reflect.Int:
+		if v.Int() == 0 {
+			return
+		}
+		if kind == "dateTime" {
+			g.add(subject, iri(predicate), literal(toISOTime(v.Int()), xsdDateTime))
+			return
+		}
+		g.add(subject, iri(predicate), literal(fmt.Sprintf("%d", v.Int()), xsdInteger))
+	case reflect.String:
+		value := v.String()
+		switch {
+		case value == "":
+		case kind == "":
+			g.add(subject, iri(predicate), literal(value, xsdString))
+		case kind == "iri":
+			g.add(subject, iri(predicate), iri(expandPrefix(value)))
+		default:
+			g.add(subject, iri(predicate), resource(kind, value))
+		}
+	}
+}
+
+// localName matches the local names which can be written as a prefixed name in turtle without escaping.
+var localName = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.\-]|%[0-9A-Fa-f]{2})*$`)
+
+// escapeIRI percent-encodes the characters which are not allowed in an IRI reference.
+// A \u escape would not do, parsers unescape it to the same invalid IRI.
+func escapeIRI(s string) string {
+	var buf bytes.Buffer
+	for _, r := range s {
+		if r <= 0x20 || r == 0x7F || strings.ContainsRune("<>\"{}|^`\\", r) {
+			fmt.Fprintf(&buf, "%%%02X", r)
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// escapeLiteral escapes a string for use in a quoted literal.
+func escapeLiteral(s string) string {
+	var buf bytes.Buffer
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7F {
+				fmt.Fprintf(&buf, "\\u%04X", r)
+				continue
+			}
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// turtleWriter renders terms in turtle, using prefixed names where possible.
+// With absolute set it renders terms as N-Triples instead, labelling blank nodes with blankSuffix.
+type turtleWriter struct {
+	used        map[string]string
+	absolute    bool
+	blankSuffix string
+}
+
+func (w *turtleWriter) iri(value string) string {
+	if w.absolute {
+		return "<" + escapeIRI(value) + ">"
+	}
+	if value == rdfType {
+		return "a"
+	}
+	for _, namespaces := range []map[string]string{prefixes, resourceNamespaces} {
+		if prefix, local, ok := splitIRI(value, namespaces); ok && localName.MatchString(local) && !strings.HasSuffix(local, ".") {
+			w.used[prefix] = namespaces[prefix]
+			return prefix + ":" + local
+		}
+	}
+	return "<" + escapeIRI(value) + ">"
+}
+
+func (w *turtleWriter) term(t term) string {
+	switch t.kind {
+	case blankTerm:
+		return "_:" + t.value + w.blankSuffix
+	case literalTerm:
+		if t.datatype == "" || t.datatype == xsdString {
+			return `"` + escapeLiteral(t.value) + `"`
+		}
+		return `"` + escapeLiteral(t.value) + `"^^` + w.iri(t.datatype)
+	default:
+		return w.iri(t.value)
+	}
+}
+
+// turtle serializes the graph as a single line of turtle, starting with the prefixes it uses.
+// Blank nodes are written inline ([ ... ]), so events can be concatenated into a single document.
+// When name is set, the triples are wrapped in that named graph, which makes it TriG instead.
+func (g *graph) turtle(name *term) []byte {
+	w := &turtleWriter{used: map[string]string{}}
+	graph := ""
+	if name != nil {
+		graph = w.term(*name) + " { "
+	}
+	subjects, properties := g.subjects()
+	var body bytes.Buffer
+	for _, subject := range subjects {
+		if subject.kind == blankTerm {
+			continue
+		}
+		body.WriteString(w.term(subject))
+		body.WriteString(" ")
+		g.writeProperties(&body, w, properties, properties[subject])
+		body.WriteString(" . ")
+	}
+
+	var output bytes.Buffer
+	names := make([]string, 0, len(w.used))
+	for prefix := range w.used {
+		names = append(names, prefix)
+	}
+	sort.Strings(names)
+	for _, prefix := range names {
+		fmt.Fprintf(&output, "@prefix %s: <%s> . ", prefix, escapeIRI(w.used[prefix]))
+	}
+	output.WriteString(graph)
+	output.Write(bytes.TrimSuffix(body.Bytes(), []byte(" ")))
+	if name != nil {
+		output.WriteString(" }")
+	}
+	return output.Bytes()
+}
+
+// nquads serializes the graph as N-Triples, with a statement per line, or as N-Quads when name is set.
+// Blank node labels are made unique per event (by the IRI of root), so events can be concatenated into a single document.
+func (g *graph) nquads(root term, name *term) []byte {
+	w := &turtleWriter{absolute: true, blankSuffix: "-" + derivedUUID(root.value)}
+	lines := make([]string, 0, len(g.triples))
+	for _, t := range g.triples {
+		line := w.term(t.subject) + " " + w.term(t.predicate) + " " + w.term(t.object)
+		if name != nil {
+			line += " " + w.term(*name)
+		}
+		lines = append(lines, line+" .")
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// writeProperties writes a predicate object list, grouping consecutive objects of the same predicate.
+func (g *graph) writeProperties(buf *bytes.Buffer, w *turtleWriter, properties map[term][]triple, triples []triple) {
+	for i, t := range triples {
+		switch {
+		case i == 0:
+		case t.predicate == triples[i-1].predicate:
+			buf.WriteString(" , ")
+		default:
+			buf.WriteString(" ; ")
+		}
+		if i == 0 || t.predicate != triples[i-1].predicate {
+			buf.WriteString(w.term(t.predicate))
+			buf.WriteString(" ")
+		}
+		if t.object.kind == blankTerm {
+			buf.WriteString("[ ")
+			g.writeProperties(buf, w, properties, properties[t.object])
+			buf.WriteString(" ]")
+			continue
+		}
+		buf.WriteString(w.term(t.object))
+	}
+}
+
+// subjects returns the subjects of the graph in order of appearance, together with their triples.
+func (g *graph) subjects() ([]term, map[term][]triple) {
+	subjects := []term{}
+	properties := map[term][]triple{}
+	for _, t := range g.triples {
+		if _, ok := properties[t.subject]; !ok {
+			subjects = append(subjects, t.subject)
+		}
+		properties[t.subject] = append(properties[t.subject], t)
+	}
+	return subjects, properties
+}
+
+// createTTLMarshal creates a function that renders a log or policy in turtle syntax,
+// according to the rdf tags of their fields.
+// The created function is meant to be API compatible with json.Marshal.
+func createTTLMarshal() func(v interface{}) ([]byte, error) {
+	return func(v interface{}) ([]byte, error) {
+		g := newGraph()
+		g.describe(v)
+		return g.turtle(nil), nil
+	}
+}
+
+// createTriGMarshal creates a function that renders a log or policy in TriG syntax,
+// in the named graph given by scheme (eg: a graph per user).
+func createTriGMarshal(scheme string) func(v interface{}) ([]byte, error) {
+	return func(v interface{}) ([]byte, error) {
+		g := newGraph()
+		g.describe(v)
+		if name, ok := graphName(scheme, v); ok {
+			return g.turtle(&name), nil
+		}
+		return g.turtle(nil), nil
+	}
+}
+
+// createNQuadsMarshal creates a function that renders a log or policy as N-Quads,
+// in the named graph given by scheme, or as N-Triples when scheme is empty.
+func createNQuadsMarshal(scheme string) func(v interface{}) ([]byte, error) {
+	return func(v interface{}) ([]byte, error) {
+		g := newGraph()
+		root := g.describe(v)
+		if name, ok := graphName(scheme, v); ok {
+			return g.nquads(root, &name), nil
+		}
+		return g.nquads(root, nil), nil
+	}
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testGraph builds a graph with the terms which need escaping.
+func testGraph() (*graph, term) {
+	g := newGraph()
+	subject := iri("http://example.com/odd iri/<{braces}>|\"quoted\"^`tick`\\back")
+	g.add(subject, iri(rdfType), iri(expandPrefix("splog:LogEntry")))
+	g.add(subject, iri(expandPrefix("dct:description")), literal("a \"quoted\" \\ backslash\nand a second line\r\n\ttabbed \u0001 é", xsdString))
+	g.add(subject, iri(expandPrefix("dct:description")), literal("", xsdString))
+	node := g.blank()
+	g.add(subject, iri(expandPrefix("svp:simplePolicy")), node)
+	g.add(node, iri(expandPrefix("spl:hasData")), iri(expandPrefix("svd:name.")))
+	g.add(node, iri(expandPrefix("dct:created")), literal("42", xsdInteger))
+	return g, subject
+}
+
+// rdfCase is an event, or the escaping graph, to serialize in each of the RDF formats.
+type rdfCase struct {
+	name   string
+	graph  *graph
+	root   term
+	graphs term
+}
+
+func rdfCases(t *testing.T) []rdfCase {
+	values := []struct {
+		name  string
+		value interface{}
+	}{
+		{
+			name: "log",
+			value: log{
+				Timestamp:  1514764800123,
+				Process:    "mailing list",
+				Purpose:    "svpu:Marketing.",
+				Processing: "svpr:Collect",
+				Recipient:  "http://example.com/recipients/odd|recipient",
+				Storage:    "svl:EU",
+				UserID:     "john.",
+				Data:       []string{"svd:Contact", "svd:Location"},
+				EventID:    "6f2b3a9e-2b1c-4c7e-9a4e-1d1f0c5f8b7a",
+			},
+		},
+		{
+			name: "consent",
+			value: policy{
+				ConsentID: "c0a8e0b4-0e5f-4f1e-8a0e-7b2f6a3b1c2d",
+				Timestamp: 1514764800000,
+				Expires:   1517356800000,
+				UserID:    "jane doe",
+				SimplePolicies: []simplepolicy{
+					{Purpose: "svpu:Marketing", Processing: "svpr:Analyse", Recipient: "svr:Ours", Storage: "svl:EU", Data: "svd:Contact"},
+					{Purpose: "svpu:Account", Processing: "svpr:Collect", Recipient: "svr:Ours", Storage: "svl:EU", Data: "svd:Contact"},
+				},
+			},
+		},
+	}
+	cases := []rdfCase{}
+	for _, v := range values {
+		g := newGraph()
+		root := g.describe(v.value)
+		name, ok := graphName("user", v.value)
+		if !ok {
+			t.Fatalf("%s has no user graph", v.name)
+		}
+		cases = append(cases, rdfCase{v.name, g, root, name})
+	}
+	g, root := testGraph()
+	return append(cases, rdfCase{"escaping", g, root, iri("http://example.com/graphs/a graph")})
+}
+
+// formats returns the case serialized in each of the formats.
+func (c rdfCase) formats() map[string][]byte {
+	return map[string][]byte{
+		"ttl":  c.graph.turtle(nil),
+		"trig": c.graph.turtle(&c.graphs),
+		"nt":   c.graph.nquads(c.root, nil),
+		"nq":   c.graph.nquads(c.root, &c.graphs),
+	}
+}
+
+// TestRDFGolden compares the output with testdata/rdf, which is the check of the RDF serializers.
+// The golden files were checked by hand against the grammars, and CI parses them with rapper (an independent parser)
+// to verify that the ttl and nt, and the trig and nq files of a case describe the same graph.
+func TestRDFGolden(t *testing.T) {
+	for _, c := range rdfCases(t) {
+		for format, serialized := range c.formats() {
+			t.Run(c.name+"/"+format, func(t *testing.T) {
+				path := filepath.Join("testdata", "rdf", c.name+"."+format)
+				expected, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if actual := string(serialized) + "\n"; actual != string(expected) {
+					t.Errorf("expected %s to be\n%s\ngot\n%s", path, expected, actual)
+				}
+			})
+		}
+	}
+}
+
+func TestRDFHasProcessing(t *testing.T) {
+	hasProcessing := iri("http://www.specialprivacy.eu/langs/usage-policy#hasProcessing")
+	values := []interface{}{
+		log{Processing: "svpr:Collect", EventID: "1"},
+		policy{ConsentID: "1", SimplePolicies: []simplepolicy{{Processing: "svpr:Collect"}}},
+	}
+	for _, v := range values {
+		g := newGraph()
+		g.describe(v)
+		found := false
+		for _, t := range g.triples {
+			found = found || (t.predicate == hasProcessing && t.object == iri("http://www.specialprivacy.eu/vocabs/processing#Collect"))
+		}
+		if !found {
+			t.Errorf("expected the processing of %T to be described with %s", v, hasProcessing.value)
+		}
+		if ttl := string(g.turtle(nil)); !strings.Contains(ttl, "spl:hasProcessing svpr:Collect") {
+			t.Errorf("expected spl:hasProcessing in %s", ttl)
+		}
+	}
+}
+
+func TestRDFConsentExpiry(t *testing.T) {
+	g := newGraph()
+	g.describe(policy{ConsentID: "1", Timestamp: 1514764800000, Expires: 1517356800000})
+	expected := map[string]string{
+		"ttl": ` dct:valid "2018-01-31T00:00:00Z"^^xsd:dateTime `,
+		"nt":  `<http://www.example.com/policy/1> <http://purl.org/dc/terms/valid> "2018-01-31T00:00:00Z"^^<http://www.w3.org/2001/XMLSchema#dateTime> .`,
+	}
+	serialized := map[string]string{"ttl": string(g.turtle(nil)), "nt": string(g.nquads(resource("policies", "1"), nil))}
+	for format, statement := range expected {
+		if !strings.Contains(serialized[format], statement) {
+			t.Errorf("expected the expiry to be written in %s as %s in\n%s", format, statement, serialized[format])
+		}
+	}
+}
+
+func TestRDFLocalNames(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: expandPrefix("svpu:Marketing"), expected: "svpu:Marketing"},
+		{value: expandPrefix("svpu:Marketing.v2"), expected: "svpu:Marketing.v2"},
+		{value: expandPrefix("svpu:Marketing."), expected: "<http://www.specialprivacy.eu/vocabs/purposes#Marketing.>"},
+		{value: expandPrefix("svpu:.Marketing"), expected: "<http://www.specialprivacy.eu/vocabs/purposes#.Marketing>"},
+		{value: resourceNamespaces["users"] + "john%20doe", expected: "users:john%20doe"},
+		{value: resourceNamespaces["users"] + "john.", expected: "<http://www.example.com/users/john.>"},
+		{value: "http://example.com/a b", expected: "<http://example.com/a%20b>"},
+	}
+	for _, test := range tests {
+		w := &turtleWriter{used: map[string]string{}}
+		if actual := w.iri(test.value); actual != test.expected {
+			t.Errorf("expected %s to be written as %s, got %s", test.value, test.expected, actual)
+		}
+	}
+}
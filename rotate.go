@@ -0,0 +1,328 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pierrec/lz4"
+)
+
+type rotateConfig struct {
+	Size        int64
+	Events      int
+	Interval    time.Duration
+	Compression string
+	Keep        int
+}
+
+// enabled returns true if any of the limits which trigger a rotation is set.
+func (c rotateConfig) enabled() bool {
+	return c.Size > 0 || c.Events > 0 || c.Interval > 0
+}
+
+// compressionExtensions maps the supported compression codecs for closed segments onto their file extension.
+var compressionExtensions = map[string]string{
+	"gzip": ".gz",
+	"lz4":  ".lz4",
+	"zstd": ".zst",
+}
+
+// rotatingFileSink writes records to a sequence of files (segments), starting
+// a new one when the current segment reaches the size, event count or age limit.
+// Segment names are created from a template, in which {seq} is replaced by the
+// sequence number and {timestamp} by the time the segment was opened.
+// The template always contains {seq}, as a timestamp alone (to the second) does not make names unique.
+// Closed segments are compressed in the background, and only the last Keep
+// segments created by this sink are retained.
+// With an Interval, segments are also closed in the background once they are
+// old enough, so the last segment of an idle output is not left open.
+type rotatingFileSink struct {
+	template    string
+	config      rotateConfig
+	force       bool
+	flushEvery  time.Duration
+	file        *outputFile
+	seq         int
+	size        int64
+	events      int
+	opened      time.Time
+	segments    []string
+	names       map[string]bool
+	compressing sync.WaitGroup
+	errors      chan error
+	once        sync.Once
+	mutex       sync.Mutex
+	stop        chan struct{}
+}
+
+func newRotatingFileSink(path string, config rotateConfig, force bool, flushEvery time.Duration) (*rotatingFileSink, error) {
+	if config.Compression != "" && config.Compression != "none" {
+		if _, ok := compressionExtensions[config.Compression]; !ok {
+			return nil, fmt.Errorf("rotate-compression should be oneOf ['none', 'gzip', 'lz4', 'zstd']. Received %s", config.Compression)
+		}
+		if config.Compression == "zstd" && !zstdSupported {
+			return nil, errors.New("rotate-compression zstd requires a binary built with cgo, use gzip or lz4")
+		}
+	}
+	// Without a sequence number segments could get the same name, so add it before the extension
+	if !strings.Contains(path, "{seq}") {
+		ext := filepath.Ext(path)
+		path = strings.TrimSuffix(path, ext) + "-{seq}" + ext
+	}
+	s := &rotatingFileSink{template: path, config: config, force: force, flushEvery: flushEvery, names: map[string]bool{}, errors: make(chan error, 1)}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	if config.Interval > 0 {
+		s.rotateEvery(config.Interval)
+	}
+	return s, nil
+}
+
+// segmentName renders the template for the current segment.
+func (s *rotatingFileSink) segmentName() string {
+	name := strings.Replace(s.template, "{seq}", fmt.Sprintf("%06d", s.seq), -1)
+	return strings.Replace(name, "{timestamp}", s.opened.UTC().Format("20060102T150405Z"), -1)
+}
+
+// open starts a new segment.
+func (s *rotatingFileSink) open() error {
+	s.seq++
+	s.opened = time.Now()
+	s.size = 0
+	s.events = 0
+	name := s.segmentName()
+	// Even with force, a segment must never overwrite another segment of the same run
+	if s.names[name] {
+		return fmt.Errorf("The segment %s was already written by this run, add {seq} to the output", name)
+	}
+	s.names[name] = true
+	// The segment is compressed once it is closed, which must not overwrite an earlier run either
+	if ext, ok := compressionExtensions[s.config.Compression]; ok && !s.force {
+		if _, err := os.Stat(name + ext); err == nil {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", name+ext)
+		}
+	}
+	file, err := getOutput(name, false, s.force)
+	if err != nil {
+		return err
+	}
+	file.flushEvery(s.flushEvery)
+	s.file = file
+	return nil
+}
+
+// close finishes the current segment, compressing it in the background and enforcing the retention.
+func (s *rotatingFileSink) close() error {
+	path := s.file.path
+	err := s.file.Commit()
+	if err != nil {
+		return err
+	}
+	if ext, ok := compressionExtensions[s.config.Compression]; ok {
+		s.compressing.Add(1)
+		go func(path string) {
+			defer s.compressing.Done()
+			if err := compressFile(path, s.config.Compression, s.force); err != nil {
+				s.fail(err)
+			}
+		}(path)
+		path += ext
+	}
+	s.segments = append(s.segments, path)
+	if s.config.Keep > 0 && len(s.segments) > s.config.Keep {
+		// The oldest segments might still be compressing
+		s.compressing.Wait()
+		for _, old := range s.segments[:len(s.segments)-s.config.Keep] {
+			if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		s.segments = s.segments[len(s.segments)-s.config.Keep:]
+	}
+	return nil
+}
+
+// rotate closes the current segment and opens the next one.
+func (s *rotatingFileSink) rotate() error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// fail reports an error of a background task, which is returned by the next write.
+func (s *rotatingFileSink) fail(err error) {
+	select {
+	case s.errors <- err:
+	default:
+	}
+}
+
+// rotateEvery closes the current segment in the background once it reaches
+// the age limit, until the sink is closed. Empty segments are left open, as
+// rotating them would only create empty files.
+func (s *rotatingFileSink) rotateEvery(interval time.Duration) {
+	s.stop = make(chan struct{})
+	go func() {
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-s.stop:
+				return
+			}
+			s.mutex.Lock()
+			select {
+			case <-s.stop:
+				s.mutex.Unlock()
+				return
+			default:
+			}
+			if s.events > 0 && s.due() {
+				if err := s.rotate(); err != nil {
+					s.fail(err)
+				}
+			}
+			next := interval - time.Since(s.opened)
+			s.mutex.Unlock()
+			if next <= 0 {
+				next = interval
+			}
+			timer.Reset(next)
+		}
+	}()
+}
+
+// stopRotating stops the background rotation started by rotateEvery.
+func (s *rotatingFileSink) stopRotating() {
+	if s.stop != nil {
+		close(s.stop)
+	}
+}
+
+// due returns true if the current segment reached one of its limits.
+func (s *rotatingFileSink) due() bool {
+	return (s.config.Size > 0 && s.size >= s.config.Size) ||
+		(s.config.Events > 0 && s.events >= s.config.Events) ||
+		(s.config.Interval > 0 && time.Since(s.opened) >= s.config.Interval)
+}
+
+func (s *rotatingFileSink) write(r record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case err := <-s.errors:
+		return err
+	default:
+	}
+	if s.events > 0 && s.due() {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := fmt.Fprintf(s.file, "%s\n", r.Value)
+	s.size += int64(n)
+	s.events++
+	return err
+}
+
+// abort discards the current segment, segments which were closed already are kept.
+func (s *rotatingFileSink) abort() error {
+	var err error
+	s.once.Do(func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.stopRotating()
+		err = s.file.Close()
+		s.compressing.Wait()
+	})
+	return err
+}
+
+func (s *rotatingFileSink) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.stopRotating()
+		err = s.close()
+		s.compressing.Wait()
+		if err == nil {
+			select {
+			case err = <-s.errors:
+			default:
+			}
+		}
+	})
+	return err
+}
+
+// compressFile replaces the file at path by a compressed copy with the extension of the codec.
+// An existing compressed file is only overwritten when force is set.
+func compressFile(path string, codec string, force bool) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+	out, err := os.OpenFile(path+compressionExtensions[codec], flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var w io.WriteCloser
+	switch codec {
+	case "gzip":
+		w = gzip.NewWriter(out)
+	case "lz4":
+		w = lz4.NewWriter(out)
+	case "zstd":
+		w = newZstdWriter(out)
+	}
+	if _, err = io.Copy(w, in); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// parseSize parses a number of bytes with an optional KB, MB or GB suffix (powers of 1024), eg: 100MB.
+func parseSize(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	number := strings.ToUpper(strings.TrimSpace(value))
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(number, suffix) {
+			multiplier = m
+			number = strings.TrimSuffix(number, suffix)
+			break
+		}
+	}
+	size, err := strconv.ParseInt(strings.TrimSuffix(number, "B"), 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Could not parse %s as a size, use a number of bytes with an optional KB, MB or GB suffix", value)
+	}
+	return size * multiplier, nil
+}
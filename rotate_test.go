@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pierrec/lz4"
+)
+
+// decompressors read back the segments compressed by each codec.
+var decompressors = map[string]func(r io.Reader) (io.Reader, error){
+	"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"lz4":  func(r io.Reader) (io.Reader, error) { return lz4.NewReader(r), nil },
+}
+
+func TestCompressFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slg-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("{\"eventID\":\"1\"}\n"), 1000)
+	for codec, reader := range decompressors {
+		t.Run(codec, func(t *testing.T) {
+			path := filepath.Join(dir, "segment-"+codec+".json")
+			if err := ioutil.WriteFile(path, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := compressFile(path, codec, false); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("expected %s to be removed after compression", path)
+			}
+			f, err := os.Open(path + compressionExtensions[codec])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			r, err := reader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(actual, content) {
+				t.Errorf("expected the %s segment to decompress into the original %d bytes, got %d bytes", codec, len(content), len(actual))
+			}
+		})
+	}
+}
+
+func TestRotateIntervalWhenIdle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slg-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newRotatingFileSink(filepath.Join(dir, "logs.json"), rotateConfig{Interval: 50 * time.Millisecond}, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.write(record{Value: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	first := filepath.Join(dir, "logs-000001.json")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(first); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s to be closed by the interval without further writes", first)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The next segment is empty, so it stays open instead of producing empty files
+	time.Sleep(150 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(dir, "logs-000003.json")); !os.IsNotExist(err) {
+		t.Errorf("expected no segment to be opened after the empty one")
+	}
+}
+
+// writeSegments writes n records of size bytes (newline included) through a rotating sink in dir,
+// and returns the content of the files it left behind, by name.
+func writeSegments(t *testing.T, dir string, template string, config rotateConfig, force bool, n int, size int) map[string]string {
+	s, err := newRotatingFileSink(filepath.Join(dir, template), config, force, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := s.write(record{Value: bytes.Repeat([]byte("x"), size-1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := map[string]string{}
+	for _, f := range files {
+		content, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments[f.Name()] = string(content)
+	}
+	return segments
+}
+
+func TestRotateSegmentNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		names    *regexp.Regexp
+	}{
+		{"sequence number added", "logs.json", regexp.MustCompile(`^logs-00000[1-5]\.json$`)},
+		{"sequence number", "logs-{seq}.json", regexp.MustCompile(`^logs-00000[1-5]\.json$`)},
+		{"sequence number added to timestamp", "logs-{timestamp}.json", regexp.MustCompile(`^logs-\d{8}T\d{6}Z-00000[1-5]\.json$`)},
+		{"timestamp and sequence number", "{seq}-{timestamp}.json", regexp.MustCompile(`^00000[1-5]-\d{8}T\d{6}Z\.json$`)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "slg-rotate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			// All segments are opened within the same second, with force they must not overwrite each other
+			segments := writeSegments(t, dir, test.template, rotateConfig{Events: 10}, true, 50, 3)
+			if len(segments) != 5 {
+				t.Errorf("expected 5 segments, got %v", segments)
+			}
+			for name, content := range segments {
+				if !test.names.MatchString(name) {
+					t.Errorf("expected %s to match %s", name, test.names)
+				}
+				if lines := strings.Count(content, "\n"); lines != 10 {
+					t.Errorf("expected 10 events in %s, got %d", name, lines)
+				}
+			}
+		})
+	}
+}
+
+func TestRotateRefusesToReuseAName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slg-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newRotatingFileSink(filepath.Join(dir, "logs.json"), rotateConfig{Events: 1}, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.abort()
+	s.seq = 0
+	if err := s.rotate(); err == nil {
+		t.Error("expected an error when a segment name is used twice, even with force")
+	}
+}
+
+func TestRotateLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		config rotateConfig
+		// segments maps the segments which are left onto their number of events
+		segments map[string]int
+	}{
+		{
+			name:     "size",
+			config:   rotateConfig{Size: 25},
+			segments: map[string]int{"logs-000001.json": 3, "logs-000002.json": 3, "logs-000003.json": 3, "logs-000004.json": 1},
+		},
+		{
+			name:     "size reached exactly",
+			config:   rotateConfig{Size: 30},
+			segments: map[string]int{"logs-000001.json": 3, "logs-000002.json": 3, "logs-000003.json": 3, "logs-000004.json": 1},
+		},
+		{
+			name:     "events",
+			config:   rotateConfig{Events: 4},
+			segments: map[string]int{"logs-000001.json": 4, "logs-000002.json": 4, "logs-000003.json": 2},
+		},
+		{
+			name:     "first limit reached",
+			config:   rotateConfig{Size: 25, Events: 2},
+			segments: map[string]int{"logs-000001.json": 2, "logs-000002.json": 2, "logs-000003.json": 2, "logs-000004.json": 2, "logs-000005.json": 2},
+		},
+		{
+			name:     "keep",
+			config:   rotateConfig{Events: 2, Keep: 2},
+			segments: map[string]int{"logs-000004.json": 2, "logs-000005.json": 2},
+		},
+		{
+			name:     "keep more than written",
+			config:   rotateConfig{Events: 4, Keep: 5},
+			segments: map[string]int{"logs-000001.json": 4, "logs-000002.json": 4, "logs-000003.json": 2},
+		},
+		{
+			name:     "keep compressed",
+			config:   rotateConfig{Events: 3, Keep: 2, Compression: "gzip"},
+			segments: map[string]int{"logs-000003.json.gz": 3, "logs-000004.json.gz": 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "slg-rotate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			segments := writeSegments(t, dir, "logs.json", test.config, false, 10, 10)
+			events := map[string]int{}
+			for name, content := range segments {
+				if test.config.Compression != "" {
+					r, err := decompressors[test.config.Compression](strings.NewReader(content))
+					if err != nil {
+						t.Fatal(err)
+					}
+					decompressed, err := ioutil.ReadAll(r)
+					if err != nil {
+						t.Fatal(err)
+					}
+					content = string(decompressed)
+				}
+				events[name] = strings.Count(content, "\n")
+			}
+			if !reflect.DeepEqual(events, test.segments) {
+				t.Errorf("expected segments %v, got %v", test.segments, events)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int64
+		fails    bool
+	}{
+		{value: "", expected: 0},
+		{value: "512", expected: 512},
+		{value: "512B", expected: 512},
+		{value: "4KB", expected: 4 << 10},
+		{value: "100mb", expected: 100 << 20},
+		{value: " 2GB ", expected: 2 << 30},
+		{value: "-1", fails: true},
+		{value: "1.5MB", fails: true},
+		{value: "MB", fails: true},
+	}
+	for _, test := range tests {
+		size, err := parseSize(test.value)
+		if test.fails {
+			if err == nil {
+				t.Errorf("expected an error for %q, got %d", test.value, size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected %q to be parsed, got %s", test.value, err)
+		} else if size != test.expected {
+			t.Errorf("expected %q to be %d bytes, got %d", test.value, test.expected, size)
+		}
+	}
+}
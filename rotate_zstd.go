@@ -0,0 +1,17 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"io"
+
+	"github.com/DataDog/zstd"
+)
+
+// zstdSupported is true when the zstd codec, which is a cgo package, is part of the binary.
+const zstdSupported = true
+
+func newZstdWriter(w io.Writer) io.WriteCloser {
+	return zstd.NewWriter(w)
+}
@@ -0,0 +1,14 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import "io"
+
+// zstdSupported is false because the zstd codec needs cgo.
+// Sinks refuse zstd compression then, so newZstdWriter is never called.
+const zstdSupported = false
+
+func newZstdWriter(w io.Writer) io.WriteCloser {
+	panic("zstd compression requires a binary built with cgo")
+}
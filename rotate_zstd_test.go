@@ -0,0 +1,14 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"io"
+
+	"github.com/DataDog/zstd"
+)
+
+func init() {
+	decompressors["zstd"] = func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r), nil }
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// cancelOnSignal calls cancel when the process receives SIGINT or SIGTERM, so a
+// run can shut down gracefully (eg: when a container is stopped).
+// A second signal terminates the process straight away.
+// The returned function stops listening for signals.
+func cancelOnSignal(cancel context.CancelFunc) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			signal.Stop(signals)
+			fmt.Fprintf(os.Stderr, "[INFO] Received %s, shutting down\n", sig)
+			cancel()
+		case <-stop:
+			signal.Stop(signals)
+		}
+	}()
+	return func() { close(stop) }
+}
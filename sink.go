@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// record is a serialized event, ready to be written to a sink.
+type record struct {
+	Key   string
+	Value []byte
+	Label *label
+}
+
+// sink is a destination for serialized events.
+// Sinks are created by openSink, based on the scheme of the output URI.
+type sink interface {
+	// write sends a single record to the destination.
+	// Buffered sinks deliver the records in the background (eg: every flush-interval) and when they are closed.
+	write(r record) error
+	// Close flushes and releases the destination. It is safe to call it more than once.
+	Close() error
+}
+
+// aborter is implemented by sinks which can discard what was written to them after a failure.
+type aborter interface {
+	// abort releases the destination without completing it. It does nothing after Close.
+	abort() error
+}
+
+// abortSink releases a sink after a failure, discarding its output if the sink supports that.
+// It does nothing for sinks which were closed already.
+func abortSink(s sink) error {
+	if a, ok := s.(aborter); ok {
+		return a.abort()
+	}
+	return s.Close()
+}
+
+// sinkOptions are the settings used to open a sink which are not part of its URI.
+type sinkOptions struct {
+	kafka      kafkaConfig
+	kafkaTopic string
+	http       httpConfig
+	rotate     rotateConfig
+	append     bool
+	force      bool
+	// flushInterval is the interval at which buffered file outputs are flushed
+	flushInterval time.Duration
+	// format is the serialization format of the records, which sets the content type of http requests
+	format string
+	// shutdown is closed when the run is interrupted, failed deliveries are no longer retried then
+	shutdown <-chan struct{}
+}
+
+// sinkOpeners maps URI schemes onto the function which opens a sink for them.
+// Supporting a new destination only requires registering it here.
+var sinkOpeners = map[string]func(u *url.URL, options sinkOptions) (sink, error){
+	"file":  openFileSink,
+	"kafka": openKafkaSink,
+	"http":  openHTTPSink,
+	"https": openHTTPSink,
+}
+
+// openSink opens the sink for an output, which can be a URI (eg: file:///tmp/logs.json, kafka://broker:9092/topic or https://host/logs),
+// the special value 'kafka' (to use the kafka options), or a path. Empty outputs and '-' write to stdout.
+func openSink(output string, options sinkOptions) (sink, error) {
+	switch {
+	case output == "" || output == "-":
+		return &stdoutSink{file: openStdout(options.flushInterval)}, nil
+	case output == "kafka":
+		return openKafkaSink(&url.URL{Scheme: "kafka"}, options)
+	case !strings.Contains(output, "://"):
+		return openFileSink(&url.URL{Scheme: "file", Path: output}, options)
+	}
+
+	u, err := url.Parse(output)
+	if err != nil {
+		return nil, err
+	}
+	opener, ok := sinkOpeners[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported output scheme %s in %s", u.Scheme, output)
+	}
+	return opener(u, options)
+}
+
+// splitFormat removes the format query parameter from an output URI (eg: file:///tmp/logs.ttl?format=ttl)
+// and returns the remaining output together with the format, which is empty when none was given.
+func splitFormat(output string) (string, string, error) {
+	if !strings.Contains(output, "://") {
+		return output, "", nil
+	}
+	u, err := url.Parse(output)
+	if err != nil {
+		return "", "", err
+	}
+	query := u.Query()
+	format := query.Get("format")
+	query.Del("format")
+	u.RawQuery = query.Encode()
+	return u.String(), format, nil
+}
+
+// fileSink writes records as lines to a file, which is only put in place when the sink is closed.
+type fileSink struct {
+	file *outputFile
+}
+
+// openFileSink opens a sink for a file:// URI, which should have an absolute path and no host (eg: file:///tmp/logs.json).
+// The file is rotated when any of the rotation limits is set.
+func openFileSink(u *url.URL, options sinkOptions) (sink, error) {
+	if u.Host != "" || u.Path == "" {
+		return nil, fmt.Errorf("A file URI should have a path and no host, eg: file:///tmp/logs.json. Received %s", u)
+	}
+	if options.rotate.enabled() {
+		if options.append {
+			return nil, errors.New("Appending to a file output can not be combined with rotation")
+		}
+		return newRotatingFileSink(u.Path, options.rotate, options.force, options.flushInterval)
+	}
+	file, err := getOutput(u.Path, options.append, options.force)
+	if err != nil {
+		return nil, err
+	}
+	file.flushEvery(options.flushInterval)
+	return &fileSink{file: file}, nil
+}
+
+func (s *fileSink) write(r record) error {
+	_, err := fmt.Fprintf(s.file, "%s\n", r.Value)
+	return err
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Commit()
+}
+
+func (s *fileSink) abort() error {
+	return s.file.Close()
+}
+
+// stdoutSink writes records as lines to stdout, through the buffer shared by all stdout sinks.
+type stdoutSink struct {
+	file *outputFile
+	once sync.Once
+}
+
+func (s *stdoutSink) write(r record) error {
+	// A single write per record, so it is never split by the writes of another stdout sink
+	_, err := fmt.Fprintf(s.file, "%s\n", r.Value)
+	return err
+}
+
+func (s *stdoutSink) Close() error {
+	var err error
+	s.once.Do(func() {
+		err = releaseStdout()
+	})
+	return err
+}
+
+// kafkaSink produces records on a kafka topic, using the record key as message key.
+type kafkaSink struct {
+	sender kafkaSender
+	topic  string
+}
+
+// openKafkaSink opens a sink for a kafka:// URI.
+// The host of the URI is a comma separated list of brokers and the path is the topic.
+// Both default to the kafka options when they are not part of the URI.
+func openKafkaSink(u *url.URL, options sinkOptions) (sink, error) {
+	config := options.kafka
+	if u.Host != "" {
+		config.BrokerList = strings.Split(u.Host, ",")
+	}
+	topic := options.kafkaTopic
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		topic = path
+	}
+
+	fmt.Fprintln(os.Stderr, "[INFO] Writing logs to kafka")
+	sender, err := createKafkaProducer(config)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "[INFO] Successfully connected to kafka cluster at %s\n", config.BrokerList)
+	return &kafkaSink{sender: sender, topic: topic}, nil
+}
+
+// withTopic returns a sink which produces on another topic, sharing the connection to kafka.
+func (s *kafkaSink) withTopic(topic string) *kafkaSink {
+	return &kafkaSink{sender: s.sender, topic: topic}
+}
+
+func (s *kafkaSink) write(r record) error {
+	return s.sender.send(&sarama.ProducerMessage{
+		Topic:   s.topic,
+		Key:     sarama.StringEncoder(r.Key),
+		Value:   sarama.ByteEncoder(r.Value),
+		Headers: r.Label.headers(),
+	})
+}
+
+func (s *kafkaSink) Close() error {
+	return s.sender.Close()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStdoutSinksShareTheBuffer(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	original := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = original }()
+
+	// Eg: -o - --consent-output -
+	sinks := []sink{}
+	for _, output := range []string{"-", ""} {
+		s, err := openSink(output, sinkOptions{flushInterval: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sinks = append(sinks, s)
+	}
+
+	lines := make(chan []string)
+	go func() {
+		read := []string{}
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			read = append(read, scanner.Text())
+		}
+		lines <- read
+	}()
+
+	// Alternating between the sinks, so separate buffers would be flushed in the middle of each other's records
+	const records = 3000
+	for n := 0; n < records; n++ {
+		value := fmt.Sprintf(`{"sink":%d,"n":%d,"padding":%q}`, n%len(sinks), n, strings.Repeat("x", n%2000))
+		if err := sinks[n%len(sinks)].write(record{Value: []byte(value)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	read := <-lines
+	if len(read) != records {
+		t.Errorf("expected %d lines, got %d", records, len(read))
+	}
+	for _, line := range read {
+		if !json.Valid([]byte(line)) {
+			t.Fatalf("expected every line to be a record, got %.80s", line)
+		}
+	}
+}
+
+func TestOpenFileSinkErrors(t *testing.T) {
+	// file://logs.json has logs.json as its host, not as its path
+	for _, output := range []string{"file://logs.json", "file://host/tmp/logs.json", "file://"} {
+		if s, err := openSink(output, sinkOptions{}); err == nil {
+			abortSink(s)
+			t.Errorf("expected an error for %s", output)
+		}
+	}
+}
+
+// BenchmarkFileSink measures writing records of a typical event size through a buffered file output,
+// compared to writing every record straight to the file as the unbuffered baseline.
+func BenchmarkFileSink(b *testing.B) {
+	dir, err := ioutil.TempDir("", "slg-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := record{Value: bytes.Repeat([]byte("x"), 1024)}
+
+	b.Run("buffered", func(b *testing.B) {
+		s, err := openFileSink(&url.URL{Path: filepath.Join(dir, "buffered.json")}, sinkOptions{flushInterval: time.Second, force: true})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(r.Value) + 1))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := s.write(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := s.Close(); err != nil {
+			b.Fatal(err)
+		}
+	})
+
+	b.Run("unbuffered", func(b *testing.B) {
+		f, err := os.Create(filepath.Join(dir, "unbuffered.json"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(r.Value) + 1))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := fmt.Fprintf(f, "%s\n", r.Value); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
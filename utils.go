@@ -1,49 +1,254 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// newRand creates a random source from seed.
+// When seeded is false the source is seeded from the current time instead.
+func newRand(seed int64, seeded bool) *rand.Rand {
+	if !seeded {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
 // makeUUIDList creates a list of random UUID strings of length n.
-func makeUUIDList(n int) []string {
+func makeUUIDList(r *rand.Rand, n int) []string {
 	output := make([]string, n)
 	for i := 0; i < n; i++ {
-		output[i] = randomUUID()
+		output[i] = randomUUID(r)
 	}
 	return output
 }
 
-// randomUUID creates a random UUID and return its string representation
-func randomUUID() string {
-	return uuid.New().String()
+// randomUUID creates a random (version 4) UUID from r and return its string representation
+func randomUUID(r *rand.Rand) string {
+	var id uuid.UUID
+	r.Read(id[:])
+	id[6] = (id[6] & 0x0f) | 0x40 // Version 4
+	id[8] = (id[8] & 0x3f) | 0x80 // Variant is 10
+	return id.String()
+}
+
+// derivedUUID creates a UUID which is uniquely determined by name.
+// It is used for identifiers that need to be stable for a given event, without consuming randomness.
+func derivedUUID(name string) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(name)).String()
 }
 
 // getRandomValue picks a random value from the values and returns it.
-func getRandomValue(values []string) string {
-	return values[rand.Intn(len(values))]
+func getRandomValue(r *rand.Rand, values []string) string {
+	return values[r.Intn(len(values))]
 }
 
 // getRandomList selects a random subset of values and returns it as an array.
-func getRandomList(values []string) []string {
-	length := rand.Intn(len(values)) + 1
+// The values are shuffled in place, so the subset is copied to keep earlier results intact.
+func getRandomList(r *rand.Rand, values []string) []string {
+	length := r.Intn(len(values)) + 1
 	for i := len(values) - 1; i > 0; i-- {
-		j := rand.Intn(i + 1)
+		j := r.Intn(i + 1)
 		values[i], values[j] = values[j], values[i]
 	}
-	return values[0:length]
+	output := make([]string, length)
+	copy(output, values)
+	return output
+}
+
+// parseTime parses a timestamp in RFC3339 format or a date in yyyy-mm-dd format (which is interpreted as UTC).
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Could not parse %s as a time, use RFC3339 (eg: 2018-01-01T00:00:00Z) or yyyy-mm-dd", value)
+}
+
+// outputFile is a file opened by getOutput.
+// Unless it is stdout or appended to, it is written to a temporary file next to
+// the requested path, which only takes its place when the output is committed.
+// This way a partially written file is never mistaken for a complete one.
+// Writes are buffered, the buffer is written out by Flush, flushEvery and when the output is closed.
+type outputFile struct {
+	*os.File
+	path   string
+	writer *bufio.Writer
+	mutex  sync.Mutex
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// outputBufferSize is the size of the write buffer of an outputFile.
+const outputBufferSize = 256 * 1024
+
+func newOutputFile(file *os.File, path string) *outputFile {
+	return &outputFile{File: file, path: path, writer: bufio.NewWriterSize(file, outputBufferSize)}
+}
+
+// stdout is shared by all the outputs which write to stdout, so the records of one output
+// are never flushed in the middle of a record of another. It is committed when the last of them is closed.
+var stdout struct {
+	sync.Mutex
+	file  *outputFile
+	users int
+}
+
+// openStdout returns the shared stdout output, which is flushed at the given interval.
+func openStdout(flushInterval time.Duration) *outputFile {
+	stdout.Lock()
+	defer stdout.Unlock()
+	if stdout.users == 0 {
+		stdout.file = newOutputFile(os.Stdout, "")
+		stdout.file.flushEvery(flushInterval)
+	}
+	stdout.users++
+	return stdout.file
+}
+
+// releaseStdout releases an output opened by openStdout, it only flushes while stdout is used by other outputs.
+func releaseStdout() error {
+	stdout.Lock()
+	defer stdout.Unlock()
+	stdout.users--
+	if stdout.users > 0 {
+		return stdout.file.Flush()
+	}
+	return stdout.file.Commit()
 }
 
 // getOutput will open a writable file or return stdout if file is empty.
-func getOutput(file string) (*os.File, error) {
+// An existing file is only appended to or overwritten when append or force is set.
+func getOutput(file string, append bool, force bool) (*outputFile, error) {
 	if file == "" {
-		return os.Stdout, nil
+		return newOutputFile(os.Stdout, ""), nil
+	}
+	if append {
+		output, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, err
+		}
+		return newOutputFile(output, ""), nil
 	}
-	output, err := os.Create(file)
+	if fi, err := os.Stat(file); err == nil {
+		// Devices and pipes (eg: /dev/stderr or a fifo) are written to as they are, not replaced
+		if !fi.Mode().IsRegular() {
+			output, err := os.OpenFile(file, os.O_WRONLY, 0)
+			if err != nil {
+				return nil, err
+			}
+			return newOutputFile(output, ""), nil
+		}
+		if !force {
+			return nil, fmt.Errorf("%s already exists, use --force to overwrite it", file)
+		}
+	}
+	output, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".")
 	if err != nil {
 		return nil, err
 	}
-	return output, nil
+	// Temporary files are only readable by their owner, while the output should look like any other file
+	err = output.Chmod(0644)
+	if err != nil {
+		output.Close()
+		os.Remove(output.Name())
+		return nil, err
+	}
+	return newOutputFile(output, file), nil
+}
+
+func (f *outputFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.writer.Write(p)
+}
+
+// Flush writes out the buffered data.
+func (f *outputFile) Flush() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.writer.Flush()
+}
+
+// flushEvery flushes the output in the background at the given interval until it is closed,
+// so readers (eg: tail -f) see events without waiting for the buffer to fill up.
+// Errors are returned by the next write.
+func (f *outputFile) flushEvery(interval time.Duration) {
+	if interval <= 0 || f.stop != nil {
+		return
+	}
+	f.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f.Flush()
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopFlushing stops the background flushes started by flushEvery.
+func (f *outputFile) stopFlushing() {
+	if f.stop != nil {
+		close(f.stop)
+	}
+}
+
+// Commit flushes and closes the output and moves it into place.
+func (f *outputFile) Commit() error {
+	err := errors.New("output was already closed")
+	f.once.Do(func() {
+		f.stopFlushing()
+		err = f.Flush()
+		if f.File == os.Stdout {
+			return
+		}
+		if err != nil {
+			f.File.Close()
+			return
+		}
+		err = f.File.Close()
+		if err == nil && f.path != "" {
+			err = os.Rename(f.File.Name(), f.path)
+		}
+	})
+	return err
+}
+
+// Close closes the output, discarding it when it was not committed yet.
+// Stdout and appended files can not be discarded, so these are flushed instead.
+func (f *outputFile) Close() error {
+	var err error
+	f.once.Do(func() {
+		f.stopFlushing()
+		if f.path == "" {
+			err = f.Flush()
+		}
+		if f.File == os.Stdout {
+			return
+		}
+		if closeErr := f.File.Close(); err == nil {
+			err = closeErr
+		}
+		if f.path != "" {
+			os.Remove(f.File.Name())
+		}
+	})
+	return err
 }
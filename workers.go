@@ -0,0 +1,52 @@
+package main
+
+// workerBacklog is the number of messages per worker which can be serialized
+// ahead of the message that is being written.
+const workerBacklog = 64
+
+// serialized is a message together with the result of serializing it.
+// The result is available once done is closed.
+type serialized struct {
+	msg    message
+	values map[string][]byte
+	err    error
+	done   chan struct{}
+}
+
+// serializeInParallel serializes the messages received from in with the given
+// number of workers. The results are sent to the returned channel in the order
+// in which the messages were received, so the ordering of the messages (and
+// thus the ordering per key) is preserved. Only the serialization is parallel,
+// the messages are still generated one by one. The returned channel is buffered,
+// which bounds the number of messages serialized ahead of the one being written.
+// It is closed after in is closed and all messages were handed to the workers.
+func serializeInParallel(
+	workers int,
+	in <-chan message,
+	serialize func(message) (map[string][]byte, error),
+) <-chan *serialized {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan *serialized, workers)
+	out := make(chan *serialized, workers*workerBacklog)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				job.values, job.err = serialize(job.msg)
+				close(job.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(out)
+		defer close(jobs)
+		for msg := range in {
+			job := &serialized{msg: msg, done: make(chan struct{})}
+			// Reserve the place of the message in the output first, the workers never block on it
+			out <- job
+			jobs <- job
+		}
+	}()
+	return out
+}
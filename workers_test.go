@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSerializeInParallelKeepsTheOrder(t *testing.T) {
+	for _, workers := range []int{1, 4, 16} {
+		in := make(chan message)
+		go func() {
+			defer close(in)
+			for i := 0; i < 1000; i++ {
+				in <- message{Key: strconv.Itoa(i)}
+			}
+		}()
+		// Random delays make the workers finish out of order
+		r := rand.New(rand.NewSource(int64(workers)))
+		delays := make([]time.Duration, 1000)
+		for i := range delays {
+			delays[i] = time.Duration(r.Intn(200)) * time.Microsecond
+		}
+		serialize := func(msg message) (map[string][]byte, error) {
+			i, _ := strconv.Atoi(msg.Key)
+			time.Sleep(delays[i])
+			if i%100 == 99 {
+				return nil, errors.New(msg.Key)
+			}
+			return map[string][]byte{"json": []byte(msg.Key)}, nil
+		}
+
+		next := 0
+		for result := range serializeInParallel(workers, in, serialize) {
+			<-result.done
+			expected := strconv.Itoa(next)
+			if result.msg.Key != expected {
+				t.Fatalf("expected message %s with %d workers, got %s", expected, workers, result.msg.Key)
+			}
+			if next%100 == 99 {
+				if result.err == nil || result.err.Error() != expected {
+					t.Errorf("expected the error of message %s, got %v", expected, result.err)
+				}
+			} else if string(result.values["json"]) != expected {
+				t.Errorf("expected the serialization of message %s, got %s", expected, result.values["json"])
+			}
+			next++
+		}
+		if next != 1000 {
+			t.Errorf("expected 1000 messages with %d workers, got %d", workers, next)
+		}
+	}
+}